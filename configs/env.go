@@ -42,5 +42,44 @@ var (
 	DB_CONFIG    DBConfig = &EtcdConfig{
 		URL: "89.168.16.172:2379",
 	}
-	TMP_FILE_FOLDER = "/tmp/tgfuse"
+	CACHE_FOLDER           = "/var/tmp/tgfuse"         // downloaded chunks, kept across remounts
+	CACHE_MAX_BYTES        = 10 << 30                  // bytes - least recently used chunks are evicted past it, pinned ones excluded
+	MEMORY_BUDGET          = 256 << 20                 // bytes - chunk buffers past it are spilled to the cache, or downloads wait
+	STATS_ADDR             = "127.0.0.1:9180"          // address serving the usage of memory and cache, empty to disable
+	SPOOL_FOLDER           = "/var/tmp/tgfuse-spool"   // content of the chunks being written
+	JOURNAL_FOLDER         = "/var/tmp/tgfuse-journal" // files with changes not stored yet, replayed on startup. Must survive reboots
+	READ_AHEAD_CHUNKS      = 2                         // chunks downloaded after the ones being read when a file is opened
+	MAX_READ_AHEAD_CHUNKS  = 8                         // chunks downloaded after the ones being read by sequential readers
+	UPLOAD_WORKERS         = 4                         // chunks uploaded in parallel
+	UPLOAD_QUEUE_SIZE      = 64                        // chunks waiting for upload before writers are slowed down
+	DELETE_REMOTE_MESSAGES = true                      // deletes the telegram messages of removed files
+	VIRTUAL_CAPACITY       = 1 << 40                   // bytes reported as total size of the mount
+	VIRTUAL_FILES          = 1 << 20                   // files reported as maximum number of entries of the mount
+	LOCK_TTL               = 10                        // seconds - file locks of a mount that stops responding are released after it
+	RETRY_MAX_ATTEMPTS     = 6                         // attempts of a request to telegram before giving up
+	RETRY_BASE_DELAY       = 500                       // milliseconds - delay before the first retry, doubled at every attempt
+	RETRY_MAX_DELAY        = 30                        // seconds - upper bound of the delay between two attempts
+	RETRY_MAX_ELAPSED      = 5 * 60                    // seconds - a request is not retried past this time since the first attempt
+	COMPRESSION            = ""                        // codec of the uploaded chunks: zstd, gzip or empty to upload them as they are
+	COMPRESSION_MIN_SAVING = 10                        // percent - chunks shrinking less are uploaded as they are
+	DEDUPLICATE_CHUNKS     = true                      // chunks of unencrypted files with the same content share a single upload
+	CHUNKING               = "fixed"                   // strategy cutting new files: fixed every CHUNK_SIZE bytes, or cdc by content
+	CDC_AVG_CHUNK_SIZE     = 8 << 20                   // bytes - average size of the chunks cut by content, never larger than CHUNK_SIZE
+
+	// files and directories kept in the cache for offline use, local to the mount
+	PINS_FILE = "/var/tmp/tgfuse-pins.json"
+
+	// new files are encrypted when a key file or a passphrase is set. The key file
+	// holds the 32 bytes master key, raw or hex encoded, otherwise the key is
+	// derived from the passphrase. Without a salt, a random one is generated by
+	// the first mount and stored in the database. Salt and iterations must match
+	// on every mount
+	ENCRYPTION_KEY_FILE       = ""
+	ENCRYPTION_PASSPHRASE     = ""
+	ENCRYPTION_SALT           = ""
+	ENCRYPTION_KDF_ITERATIONS = 600000
+
+	// names, sizes and attributes are stored encrypted in the database and the
+	// documents are sent with opaque names. Needs the master key above
+	ENCRYPT_METADATA = false
 )
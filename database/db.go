@@ -1,17 +1,50 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"log"
 
 	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/encryption"
 	"it.smaso/tgfuse/filesystem"
 )
 
 var instance DatabaseConnection
 
+// ErrLocked is returned when a lock conflicts with the one held by someone else
+var ErrLocked = errors.New("file is locked")
+
 type DatabaseConnection interface {
+	filesystem.DedupIndex
+	encryption.SaltStore
 	GetAllChunkFiles() (*[]*filesystem.ChunkFile, error)
 	UploadFile(cf *filesystem.ChunkFile) error
+	UpdateChunks(cf *filesystem.ChunkFile, chunks []*filesystem.ChunkItem) error
+	DeleteFile(cf *filesystem.ChunkFile) error
+	SetXattr(cf *filesystem.ChunkFile, name string, value []byte) error
+	RemoveXattr(cf *filesystem.ChunkFile, name string) error
+	GetAllDirectories() (*[]*filesystem.Directory, error)
+	UploadDirectory(dir *filesystem.Directory) error
+	DeleteDirectory(dir *filesystem.Directory) error
+	GetAllLinks() (*[]*filesystem.Link, error)
+	Commit(batch Batch) error
+	// GetLock returns a lock held by another owner conflicting with lk, if any
+	GetLock(cf *filesystem.ChunkFile, lk filesystem.FileLock) (*filesystem.FileLock, error)
+	// SetLock acquires or releases lk for its owner. When wait is set it
+	// blocks until the conflicting locks are released or ctx is done
+	SetLock(ctx context.Context, cf *filesystem.ChunkFile, lk filesystem.FileLock, wait bool) error
+}
+
+// Batch groups metadata changes that must be applied all together, so that
+// other mounts never see a partial update
+type Batch struct {
+	Files              []*filesystem.ChunkFile
+	Directories        []*filesystem.Directory
+	DeletedFiles       []*filesystem.ChunkFile
+	DeletedDirectories []*filesystem.Directory
+	Links              []*filesystem.Link
+	DeletedLinks       []*filesystem.Link
 }
 
 func Connect(conf configs.DBConfig) DatabaseConnection {
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"it.smaso/tgfuse/filesystem"
+)
+
+// dedupEntry is the value stored for each hash of the dedup index, the document
+// holding the content together with the number of chunks referencing it
+type dedupEntry struct {
+	filesystem.DedupEntry
+	Refs int
+}
+
+func dedupKey(hash string) string {
+	return fmt.Sprintf("/dedup/%s", hash)
+}
+
+// getDedupEntry returns the entry of hash and its revision, which is 0 when
+// there's none
+func (e *etcdClient) getDedupEntry(hash string) (*dedupEntry, int64, error) {
+	cli, err := e.getClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := cli.Get(ctx, dedupKey(hash))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, 0, err
+	}
+	var entry dedupEntry
+	value := openValue(dedupKey(hash), string(resp.Kvs[0].Value))
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		return nil, 0, err
+	}
+	return &entry, resp.Kvs[0].ModRevision, nil
+}
+
+// updateDedupEntry applies op to the entry of hash unless it changed since
+// revision, returning whether it was applied
+func (e *etcdClient) updateDedupEntry(hash string, revision int64, op clientv3.Op) (bool, error) {
+	cli, err := e.getClient()
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(dedupKey(hash)), "=", revision)).
+		Then(op).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func putDedupEntry(hash string, entry *dedupEntry) (clientv3.Op, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return clientv3.Op{}, err
+	}
+	// the entry holds the checksum of the document, a fingerprint of content
+	// uploaded as it is
+	value, err := sealValue(dedupKey(hash), string(data))
+	if err != nil {
+		return clientv3.Op{}, err
+	}
+	return clientv3.OpPut(dedupKey(hash), value), nil
+}
+
+func (e *etcdClient) AcquireContent(hash string) (*filesystem.DedupEntry, error) {
+	// other mounts may change the references in the meantime
+	for {
+		entry, revision, err := e.getDedupEntry(hash)
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		entry.Refs++
+		op, err := putDedupEntry(hash, entry)
+		if err != nil {
+			return nil, err
+		}
+		if applied, err := e.updateDedupEntry(hash, revision, op); err != nil || applied {
+			return &entry.DedupEntry, err
+		}
+	}
+}
+
+func (e *etcdClient) RegisterContent(hash string, entry filesystem.DedupEntry) (bool, error) {
+	op, err := putDedupEntry(hash, &dedupEntry{DedupEntry: entry, Refs: 1})
+	if err != nil {
+		return false, err
+	}
+	// a missing key has revision 0
+	return e.updateDedupEntry(hash, 0, op)
+}
+
+func (e *etcdClient) ReleaseContent(hash string) (bool, error) {
+	for {
+		entry, revision, err := e.getDedupEntry(hash)
+		if err != nil || entry == nil {
+			return false, err
+		}
+		entry.Refs--
+		op := clientv3.OpDelete(dedupKey(hash))
+		if entry.Refs > 0 {
+			if op, err = putDedupEntry(hash, entry); err != nil {
+				return false, err
+			}
+		}
+		applied, err := e.updateDedupEntry(hash, revision, op)
+		if err != nil {
+			return false, err
+		}
+		if applied {
+			return entry.Refs <= 0, nil
+		}
+	}
+}
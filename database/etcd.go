@@ -4,13 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
 	"it.smaso/tgfuse/configs"
 	"it.smaso/tgfuse/filesystem"
 	"it.smaso/tgfuse/logger"
@@ -20,12 +23,35 @@ type etcdClient struct {
 	DatabaseConnection
 	configs configs.EtcdConfig
 	client  *clientv3.Client
+
+	// session owns the lease the file locks of this mount are attached to
+	sessionLock sync.Mutex
+	session     *concurrency.Session
 }
 
+// MAX_TXN_OPS is the maximum number of operations etcd accepts in a single
+// transaction with its default configuration
+const MAX_TXN_OPS = 128
+
 type KeyParam struct {
 	Key      string
 	GetValue func() string
 	SetValue func(string)
+	// Sealed values are stored encrypted when metadata is encrypted
+	Sealed bool
+	// Err is the failure building the key, returned when the value is stored
+	Err error
+}
+
+// value returns what is stored under the key
+func (p KeyParam) value() (string, error) {
+	if p.Err != nil {
+		return "", p.Err
+	}
+	if !p.Sealed {
+		return p.GetValue(), nil
+	}
+	return sealValue(p.Key, p.GetValue())
 }
 
 type Keyed interface {
@@ -42,12 +68,28 @@ type KeyedChunkItem struct {
 	chunkItem *filesystem.ChunkItem
 }
 
+type KeyedDirectory struct {
+	Keyed
+	directory *filesystem.Directory
+}
+
+type KeyedLink struct {
+	Keyed
+	link *filesystem.Link
+}
+
 type SendKeyErr struct {
 	Key string
 	Err error
 }
 
 func (e *etcdClient) UploadFile(cf *filesystem.ChunkFile) error {
+	for _, ci := range cf.Chunks {
+		if ci.Dirty {
+			return fmt.Errorf("chunk [%d] of %s has not been uploaded", ci.Idx, cf.Id)
+		}
+	}
+
 	kcf := KeyedChunkFile{chunkFile: cf}
 	if err := e.SendFile(&kcf); err != nil {
 		logger.LogErr(fmt.Sprintf("Failed to send ChunkFile to database: %s", err.Error()))
@@ -56,9 +98,6 @@ func (e *etcdClient) UploadFile(cf *filesystem.ChunkFile) error {
 
 	for idx := range cf.Chunks {
 		chunk := cf.Chunks[idx]
-		if chunk.FileId == nil {
-			panic("Somehow the file id came null")
-		}
 		kci := KeyedChunkItem{chunkItem: chunk}
 		if err := e.SendFile(&kci); err != nil {
 			logger.LogErr(fmt.Sprintf("Failed to send ChunkItem to database: %s", err.Error()))
@@ -69,6 +108,200 @@ func (e *etcdClient) UploadFile(cf *filesystem.ChunkFile) error {
 	return nil
 }
 
+// UpdateChunks stores the given chunks and then the ChunkFile, so that the new
+// size and number of chunks are visible only once every chunk is stored
+func (e *etcdClient) UpdateChunks(cf *filesystem.ChunkFile, chunks []*filesystem.ChunkItem) error {
+	ops := []clientv3.Op{}
+	for _, ci := range chunks {
+		if ci.Dirty {
+			return fmt.Errorf("chunk [%d] of %s has not been uploaded", ci.Idx, cf.Id)
+		}
+		var err error
+		if ops, err = appendPuts(ops, &KeyedChunkItem{chunkItem: ci}); err != nil {
+			return err
+		}
+	}
+	ops, err := appendPuts(ops, &KeyedChunkFile{chunkFile: cf})
+	if err != nil {
+		return err
+	}
+
+	for batch := range slices.Chunk(ops, MAX_TXN_OPS) {
+		if err := e.commitOps(batch); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to update ChunkFile in database: %s", err.Error()))
+			return err
+		}
+	}
+
+	if err := e.deleteTrailingChunks(cf); err != nil {
+		logger.LogWarn(fmt.Sprintf("Failed to delete truncated chunks of %s: %s", cf.Id, err.Error()))
+	}
+	return nil
+}
+
+// deleteTrailingChunks removes the keys of the chunks past the end of the file,
+// left behind when the file is truncated
+func (e *etcdClient) deleteTrailingChunks(cf *filesystem.ChunkFile) error {
+	cli, err := e.getClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := cli.Get(ctx, fmt.Sprintf("/ci/%s/", cf.Id), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+
+	ops := []clientv3.Op{}
+	for _, item := range resp.Kvs {
+		comps := strings.Split(string(item.Key), "/")
+		idx, err := strconv.Atoi(comps[3])
+		if err != nil || idx < cf.NumChunks {
+			continue
+		}
+		ops = append(ops, clientv3.OpDelete(string(item.Key)))
+	}
+
+	for batch := range slices.Chunk(ops, MAX_TXN_OPS) {
+		if err := e.commitOps(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *etcdClient) commitOps(ops []clientv3.Op) error {
+	cli, err := e.getClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = cli.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+func (e *etcdClient) SetXattr(cf *filesystem.ChunkFile, name string, value []byte) error {
+	param := xattrParam(cf, name, value)
+	stored, err := param.value()
+	if err != nil {
+		return err
+	}
+	// the attribute may have been stored before metadata was encrypted
+	ops := []clientv3.Op{clientv3.OpPut(param.Key, stored)}
+	if plainKey := xattrKey(cf.Id, name); plainKey != param.Key {
+		ops = append(ops, clientv3.OpDelete(plainKey))
+	}
+	return e.commitOps(ops)
+}
+
+func (e *etcdClient) RemoveXattr(cf *filesystem.ChunkFile, name string) error {
+	ops := []clientv3.Op{clientv3.OpDelete(xattrKey(cf.Id, name))}
+	if hashed, err := hashedName(name); err == nil {
+		ops = append(ops, clientv3.OpDelete(xattrKey(cf.Id, hashed)))
+	}
+	return e.commitOps(ops)
+}
+
+func xattrKey(cfId, name string) string {
+	return fmt.Sprintf("/cf/%s/xattr/%s", cfId, name)
+}
+
+// restoreXattrs loads the extended attributes of the file, which can't be
+// listed upfront as KeyParams
+func (e *etcdClient) restoreXattrs(cf *filesystem.ChunkFile) error {
+	cli, err := e.getClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	prefix := xattrKey(cf.Id, "")
+	resp, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, item := range resp.Kvs {
+		key := string(item.Key)
+		name, value, err := openXattr(key, strings.TrimPrefix(key, prefix), string(item.Value))
+		if err != nil {
+			logger.LogWarn(fmt.Sprintf("Failed to restore xattr of cf %s: %s", cf.Id, err.Error()))
+			continue
+		}
+		cf.SetXattr(name, []byte(value))
+	}
+	return nil
+}
+
+// DeleteFile removes the ChunkFile and all of its ChunkItems at once
+func (e *etcdClient) DeleteFile(cf *filesystem.ChunkFile) error {
+	err := e.commitOps([]clientv3.Op{
+		clientv3.OpDelete(fmt.Sprintf("/cf/%s/", cf.Id), clientv3.WithPrefix()),
+		clientv3.OpDelete(fmt.Sprintf("/ci/%s/", cf.Id), clientv3.WithPrefix()),
+	})
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to delete ChunkFile from database: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// Commit applies the whole batch in a single transaction. Only the ChunkFile
+// keys are written, the ChunkItems of the updated files are left untouched
+func (e *etcdClient) Commit(batch Batch) error {
+	ops := []clientv3.Op{}
+	var err error
+	for _, cf := range batch.Files {
+		if ops, err = appendPuts(ops, &KeyedChunkFile{chunkFile: cf}); err != nil {
+			return err
+		}
+	}
+	for _, dir := range batch.Directories {
+		if ops, err = appendPuts(ops, &KeyedDirectory{directory: dir}); err != nil {
+			return err
+		}
+	}
+	for _, cf := range batch.DeletedFiles {
+		ops = append(ops,
+			clientv3.OpDelete(fmt.Sprintf("/cf/%s/", cf.Id), clientv3.WithPrefix()),
+			clientv3.OpDelete(fmt.Sprintf("/ci/%s/", cf.Id), clientv3.WithPrefix()),
+		)
+	}
+	for _, dir := range batch.DeletedDirectories {
+		ops = append(ops, clientv3.OpDelete(fmt.Sprintf("/dir/%s/", dir.Id), clientv3.WithPrefix()))
+	}
+	for _, link := range batch.Links {
+		if ops, err = appendPuts(ops, &KeyedLink{link: link}); err != nil {
+			return err
+		}
+	}
+	for _, link := range batch.DeletedLinks {
+		ops = append(ops, clientv3.OpDelete(fmt.Sprintf("/ln/%s/", link.Id), clientv3.WithPrefix()))
+	}
+
+	if err = e.commitOps(ops); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to commit batch to database: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// appendPuts appends to ops the puts storing obj
+func appendPuts(ops []clientv3.Op, obj Keyed) ([]clientv3.Op, error) {
+	for _, item := range obj.GetKeyParams() {
+		value, err := item.value()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, clientv3.OpPut(item.Key, value))
+	}
+	return ops, nil
+}
+
 func (e *etcdClient) GetAllChunkFiles() (*[]*filesystem.ChunkFile, error) {
 	cfIds, err := e.GetAllFileIds()
 	if err != nil {
@@ -78,6 +311,7 @@ func (e *etcdClient) GetAllChunkFiles() (*[]*filesystem.ChunkFile, error) {
 	logger.LogInfo(fmt.Sprintf("Retrieved %d cfIds", len(*cfIds)))
 
 	var chunkFiles []*filesystem.ChunkFile
+	mu := sync.Mutex{}
 	wg := sync.WaitGroup{}
 
 	errs := make([]error, 0)
@@ -86,14 +320,21 @@ func (e *etcdClient) GetAllChunkFiles() (*[]*filesystem.ChunkFile, error) {
 		go func(cfID string) {
 			defer wg.Done()
 			cf := filesystem.NewChunkFile(filesystem.WithId(cfID))
+			cf.Attributes = legacyAttributes(0o644)
 			keyed := KeyedChunkFile{chunkFile: cf}
 
 			if err := e.Restore(&keyed); err != nil {
 				logger.LogErr(fmt.Sprintf("Failed to restore cf: %s", err.Error()))
+				mu.Lock()
 				errs = append(errs, fmt.Errorf("failed to restore cf: %v", err))
+				mu.Unlock()
 				return
 			}
 
+			if err := e.restoreXattrs(cf); err != nil {
+				logger.LogErr(fmt.Sprintf("Failed to restore xattrs of cf %s: %s", cf.Id, err.Error()))
+			}
+
 			var curr int64 = 0
 
 			for ciIdx := range cf.NumChunks {
@@ -107,19 +348,24 @@ func (e *etcdClient) GetAllChunkFiles() (*[]*filesystem.ChunkFile, error) {
 				if err := e.Restore(&kci); err != nil {
 					logger.LogErr(fmt.Sprintf("Failed to restore cf %s", err.Error()))
 				} else {
-					ci.End = ci.Start + int64(ci.Size)
-					curr += int64(ci.Size)
-					if cf.HasBytes(ci.Start, ci.End) {
-						ci.FileState = filesystem.FILE
+					if ci.End == 0 {
+						ci.End = ci.Start + int64(ci.Size)
 					}
+					curr = ci.End
+					cf.LoadCached(ci)
 				}
 
 				cf.Chunks = append(cf.Chunks, ci)
 			}
+			if err := cf.VerifyManifest(); err != nil {
+				logger.LogErr(fmt.Sprintf("Chunks of %s may be corrupted: %s", cf.OriginalFilename, err.Error()))
+			}
 
 			cf.Enable()
 
+			mu.Lock()
 			chunkFiles = append(chunkFiles, cf)
+			mu.Unlock()
 		}((*cfIds)[idx])
 	}
 	wg.Wait()
@@ -131,6 +377,263 @@ func (e *etcdClient) GetAllChunkFiles() (*[]*filesystem.ChunkFile, error) {
 	return &chunkFiles, nil
 }
 
+func (e *etcdClient) UploadDirectory(dir *filesystem.Directory) error {
+	kd := KeyedDirectory{directory: dir}
+	if err := e.SendFile(&kd); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to send Directory to database: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (e *etcdClient) DeleteDirectory(dir *filesystem.Directory) error {
+	if err := e.delPrefix(fmt.Sprintf("/dir/%s/", dir.Id)); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to delete Directory from database: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (e *etcdClient) GetAllDirectories() (*[]*filesystem.Directory, error) {
+	dirIds, err := e.getAllIds("/dir/")
+	if err != nil {
+		return nil, err
+	}
+
+	logger.LogInfo(fmt.Sprintf("Retrieved %d dirIds", len(*dirIds)))
+
+	var dirs []*filesystem.Directory
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	errs := make([]error, 0)
+	for idx := range *dirIds {
+		wg.Add(1)
+		go func(dirID string) {
+			defer wg.Done()
+			dir := &filesystem.Directory{Id: dirID, Attributes: legacyAttributes(0o755)}
+			keyed := KeyedDirectory{directory: dir}
+
+			err := e.Restore(&keyed)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.LogErr(fmt.Sprintf("Failed to restore dir: %s", err.Error()))
+				errs = append(errs, fmt.Errorf("failed to restore dir: %v", err))
+				return
+			}
+			dirs = append(dirs, dir)
+		}((*dirIds)[idx])
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return &dirs, nil
+}
+
+func (e *etcdClient) GetAllLinks() (*[]*filesystem.Link, error) {
+	linkIds, err := e.getAllIds("/ln/")
+	if err != nil {
+		return nil, err
+	}
+
+	var links []*filesystem.Link
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	errs := make([]error, 0)
+	for idx := range *linkIds {
+		wg.Add(1)
+		go func(linkID string) {
+			defer wg.Done()
+			link := &filesystem.Link{Id: linkID}
+			keyed := KeyedLink{link: link}
+
+			err := e.Restore(&keyed)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.LogErr(fmt.Sprintf("Failed to restore link: %s", err.Error()))
+				errs = append(errs, fmt.Errorf("failed to restore link: %v", err))
+				return
+			}
+			links = append(links, link)
+		}((*linkIds)[idx])
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return &links, nil
+}
+
+// getSession returns the session of the mount, creating a new one if the lease
+// expired. The locks taken with an expired lease are gone together with it
+func (e *etcdClient) getSession() (*concurrency.Session, error) {
+	e.sessionLock.Lock()
+	defer e.sessionLock.Unlock()
+
+	if e.session != nil {
+		select {
+		case <-e.session.Done():
+			logger.LogWarn("Lock session expired, creating a new one")
+		default:
+			return e.session, nil
+		}
+	}
+
+	cli, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(configs.LOCK_TTL))
+	if err != nil {
+		return nil, err
+	}
+	e.session = session
+	return session, nil
+}
+
+func lockPrefix(cfId string) string {
+	return fmt.Sprintf("/lock/%s/", cfId)
+}
+
+// getLocks returns the locks held on the file by every mount, together with
+// the revision they were read at
+func (e *etcdClient) getLocks(ctx context.Context, cf *filesystem.ChunkFile) ([]filesystem.FileLock, int64, error) {
+	cli, err := e.getClient()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := cli.Get(ctx, lockPrefix(cf.Id), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	locks := []filesystem.FileLock{}
+	for _, item := range resp.Kvs {
+		comps := strings.Split(string(item.Key), "/")
+		lk := filesystem.FileLock{Owner: comps[3]}
+		if _, err := fmt.Sscanf(string(item.Value), "%d %d %d %d", &lk.Typ, &lk.Start, &lk.End, &lk.Pid); err != nil {
+			logger.LogWarn(fmt.Sprintf("Skipping malformed lock %s: %s", item.Key, err.Error()))
+			continue
+		}
+		locks = append(locks, lk)
+	}
+	return locks, resp.Header.Revision, nil
+}
+
+// holder returns the owner of the lock as seen by the other mounts
+func holder(session *concurrency.Session, owner string) string {
+	return fmt.Sprintf("%x-%s", session.Lease(), owner)
+}
+
+func (e *etcdClient) GetLock(cf *filesystem.ChunkFile, lk filesystem.FileLock) (*filesystem.FileLock, error) {
+	session, err := e.getSession()
+	if err != nil {
+		return nil, err
+	}
+	lk.Owner = holder(session, lk.Owner)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	locks, _, err := e.getLocks(ctx, cf)
+	if err != nil {
+		return nil, err
+	}
+	for _, held := range locks {
+		if lk.Conflicts(&held) {
+			return &held, nil
+		}
+	}
+	return nil, nil
+}
+
+func (e *etcdClient) SetLock(ctx context.Context, cf *filesystem.ChunkFile, lk filesystem.FileLock, wait bool) error {
+	session, err := e.getSession()
+	if err != nil {
+		return err
+	}
+	lk.Owner = holder(session, lk.Owner)
+
+	for {
+		revision, err := e.trySetLock(ctx, session, cf, lk)
+		if !errors.Is(err, ErrLocked) || !wait {
+			return err
+		}
+
+		// wait for any change of the locks of the file before trying again
+		cli, err := e.getClient()
+		if err != nil {
+			return err
+		}
+		watchCtx, cancel := context.WithCancel(ctx)
+		watch := cli.Watch(watchCtx, lockPrefix(cf.Id), clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+		<-watch
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// trySetLock replaces the locks of the owner on the range of lk. Changes to the
+// locks of a file are serialized by a mutex shared by every mount
+func (e *etcdClient) trySetLock(ctx context.Context, session *concurrency.Session, cf *filesystem.ChunkFile, lk filesystem.FileLock) (int64, error) {
+	mutex := concurrency.NewMutex(session, fmt.Sprintf("/lockmu/%s", cf.Id))
+	if err := mutex.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := mutex.Unlock(unlockCtx); err != nil {
+			logger.LogWarn(fmt.Sprintf("Failed to release lock mutex of %s: %s", cf.Id, err.Error()))
+		}
+	}()
+
+	opCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	locks, revision, err := e.getLocks(opCtx, cf)
+	if err != nil {
+		return 0, err
+	}
+
+	owned := []filesystem.FileLock{}
+	for _, held := range locks {
+		if held.Owner == lk.Owner {
+			owned = append(owned, held)
+		} else if lk.Typ != syscall.F_UNLCK && lk.Conflicts(&held) {
+			return revision, ErrLocked
+		}
+	}
+
+	prefix := fmt.Sprintf("%s%s/", lockPrefix(cf.Id), lk.Owner)
+	ops := []clientv3.Op{clientv3.OpDelete(prefix, clientv3.WithPrefix())}
+	for idx, held := range filesystem.ApplyLock(owned, lk) {
+		ops = append(ops, clientv3.OpPut(
+			fmt.Sprintf("%s%d", prefix, idx),
+			fmt.Sprintf("%d %d %d %d", held.Typ, held.Start, held.End, held.Pid),
+			clientv3.WithLease(session.Lease()),
+		))
+	}
+
+	cli, err := e.getClient()
+	if err != nil {
+		return 0, err
+	}
+	_, err = cli.Txn(opCtx).Then(ops...).Commit()
+	return revision, err
+}
+
 func (err SendKeyErr) Error() string { return fmt.Sprintf("%s: %s", err.Key, err.Err.Error()) }
 
 func (e *etcdClient) getClient() (*clientv3.Client, error) {
@@ -178,6 +681,18 @@ func (e *etcdClient) delKey(key string) error {
 	return nil
 }
 
+func (e *etcdClient) delPrefix(prefix string) error {
+	cli, err := e.getClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = cli.Delete(ctx, prefix, clientv3.WithPrefix())
+	return err
+}
+
 func (e *etcdClient) getKey(key string) (string, error) {
 	cli, err := e.getClient()
 	if err != nil {
@@ -196,6 +711,11 @@ func (e *etcdClient) getKey(key string) (string, error) {
 }
 
 func (e *etcdClient) GetAllFileIds() (*[]string, error) {
+	return e.getAllIds("/cf/")
+}
+
+// getAllIds returns the distinct ids found right after the given prefix
+func (e *etcdClient) getAllIds(prefix string) (*[]string, error) {
 	cli, err := e.getClient()
 	if err != nil {
 		return nil, err
@@ -203,7 +723,7 @@ func (e *etcdClient) GetAllFileIds() (*[]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	resp, err := cli.Get(ctx, "/cf", clientv3.WithPrefix())
+	resp, err := cli.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
 	if err != nil {
 		return nil, err
 	}
@@ -223,7 +743,11 @@ func (e *etcdClient) GetAllFileIds() (*[]string, error) {
 func (e *etcdClient) SendFile(obj Keyed) error {
 	params := obj.GetKeyParams()
 	for _, item := range params {
-		if err := e.putKey(item.Key, item.GetValue()); err != nil {
+		value, err := item.value()
+		if err != nil {
+			return SendKeyErr{Key: item.Key, Err: err}
+		}
+		if err := e.putKey(item.Key, value); err != nil {
 			return SendKeyErr{Key: item.Key, Err: err}
 		}
 	}
@@ -253,8 +777,8 @@ func (e *etcdClient) Restore(obj Keyed) error {
 
 func (kcf *KeyedChunkFile) GetKeyParams() []KeyParam {
 	cf := kcf.chunkFile
-	return []KeyParam{
-		{
+	params := []KeyParam{
+		sealed(KeyParam{
 			Key: fmt.Sprintf("/cf/%s/filename", cf.Id),
 			GetValue: func() string {
 				return cf.OriginalFilename
@@ -262,8 +786,17 @@ func (kcf *KeyedChunkFile) GetKeyParams() []KeyParam {
 			SetValue: func(s string) {
 				cf.OriginalFilename = s
 			},
-		},
+		}),
 		{
+			Key: fmt.Sprintf("/cf/%s/parent", cf.Id),
+			GetValue: func() string {
+				return cf.ParentId
+			},
+			SetValue: func(s string) {
+				cf.ParentId = s
+			},
+		},
+		sealed(KeyParam{
 			Key: fmt.Sprintf("/cf/%s/size", cf.Id),
 			GetValue: func() string {
 				return fmt.Sprintf("%d", cf.OriginalSize)
@@ -272,8 +805,8 @@ func (kcf *KeyedChunkFile) GetKeyParams() []KeyParam {
 				val, _ := strconv.Atoi(s)
 				cf.OriginalSize = val
 			},
-		},
-		{
+		}),
+		sealed(KeyParam{
 			Key: fmt.Sprintf("/cf/%s/num_chunks", cf.Id),
 			GetValue: func() string {
 				return fmt.Sprintf("%d", cf.NumChunks)
@@ -282,14 +815,135 @@ func (kcf *KeyedChunkFile) GetKeyParams() []KeyParam {
 				val, _ := strconv.Atoi(s)
 				cf.NumChunks = val
 			},
+		}),
+		{
+			Key: fmt.Sprintf("/cf/%s/nlink", cf.Id),
+			GetValue: func() string {
+				return strconv.Itoa(cf.Links())
+			},
+			SetValue: func(s string) {
+				cf.Nlink, _ = strconv.Atoi(s)
+			},
+		},
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/cf/%s/symlink", cf.Id),
+			GetValue: func() string {
+				return cf.SymlinkTarget
+			},
+			SetValue: func(s string) {
+				cf.SymlinkTarget = s
+			},
+		}),
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/cf/%s/manifest_hash", cf.Id),
+			GetValue: func() string {
+				return cf.ManifestHash
+			},
+			SetValue: func(s string) {
+				cf.ManifestHash = s
+			},
+		}),
+		{
+			Key: fmt.Sprintf("/cf/%s/chunking", cf.Id),
+			GetValue: func() string {
+				return cf.Chunking
+			},
+			SetValue: func(s string) {
+				cf.Chunking = s
+			},
+		},
+		{
+			Key: fmt.Sprintf("/cf/%s/key", cf.Id),
+			GetValue: func() string {
+				return cf.WrappedKey
+			},
+			SetValue: func(s string) {
+				cf.WrappedKey = s
+			},
 		},
 	}
+	params = append(params, sealAll(attributesKeyParams(fmt.Sprintf("/cf/%s", cf.Id), &cf.Attributes))...)
+
+	for name, value := range cf.Xattrs() {
+		params = append(params, xattrParam(cf, name, value))
+	}
+	return params
+}
+
+// legacyAttributes returns the attributes of the entries stored before
+// attributes were persisted, which are kept when their keys are missing
+func legacyAttributes(mode uint32) filesystem.Attributes {
+	return filesystem.Attributes{Mode: mode, Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+}
+
+// attributesKeyParams returns the keys of the attributes of the entry stored
+// under prefix. Timestamps are stored as unix nanoseconds. Missing keys leave
+// the current values untouched
+func attributesKeyParams(prefix string, attrs *filesystem.Attributes) []KeyParam {
+	uintParam := func(name string, val *uint32) KeyParam {
+		return KeyParam{
+			Key: fmt.Sprintf("%s/%s", prefix, name),
+			GetValue: func() string {
+				return strconv.FormatUint(uint64(*val), 10)
+			},
+			SetValue: func(s string) {
+				if parsed, err := strconv.ParseUint(s, 10, 32); err == nil {
+					*val = uint32(parsed)
+				}
+			},
+		}
+	}
+	timeParam := func(name string, val *time.Time) KeyParam {
+		return KeyParam{
+			Key: fmt.Sprintf("%s/%s", prefix, name),
+			GetValue: func() string {
+				return strconv.FormatInt(val.UnixNano(), 10)
+			},
+			SetValue: func(s string) {
+				if nsec, err := strconv.ParseInt(s, 10, 64); err == nil {
+					*val = time.Unix(0, nsec)
+				}
+			},
+		}
+	}
+
+	return []KeyParam{
+		uintParam("mode", &attrs.Mode),
+		uintParam("uid", &attrs.Uid),
+		uintParam("gid", &attrs.Gid),
+		timeParam("atime", &attrs.Atime),
+		timeParam("mtime", &attrs.Mtime),
+		timeParam("ctime", &attrs.Ctime),
+	}
 }
 
 func (kci *KeyedChunkItem) GetKeyParams() []KeyParam {
 	ci := kci.chunkItem
 	return []KeyParam{
-		{
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/ci/%s/%d/start", ci.ChunkFileId, ci.Idx),
+			GetValue: func() string {
+				return strconv.FormatInt(ci.Start, 10)
+			},
+			SetValue: func(s string) {
+				// chunks stored before their bounds keep the computed ones
+				if start, err := strconv.ParseInt(s, 10, 64); err == nil {
+					ci.Start = start
+				}
+			},
+		}),
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/ci/%s/%d/end", ci.ChunkFileId, ci.Idx),
+			GetValue: func() string {
+				return strconv.FormatInt(ci.End, 10)
+			},
+			SetValue: func(s string) {
+				if end, err := strconv.ParseInt(s, 10, 64); err == nil {
+					ci.End = end
+				}
+			},
+		}),
+		sealed(KeyParam{
 			Key: fmt.Sprintf("/ci/%s/%d/size", ci.ChunkFileId, ci.Idx),
 			GetValue: func() string {
 				return strconv.Itoa(ci.Size)
@@ -297,7 +951,7 @@ func (kci *KeyedChunkItem) GetKeyParams() []KeyParam {
 			SetValue: func(s string) {
 				ci.Size, _ = strconv.Atoi(s)
 			},
-		},
+		}),
 		{
 			Key: fmt.Sprintf("/ci/%s/%d/name", ci.ChunkFileId, ci.Idx),
 			GetValue: func() string {
@@ -307,14 +961,125 @@ func (kci *KeyedChunkItem) GetKeyParams() []KeyParam {
 				ci.Name = s
 			},
 		},
+		{
+			Key: fmt.Sprintf("/ci/%s/%d/message_id", ci.ChunkFileId, ci.Idx),
+			GetValue: func() string {
+				return strconv.Itoa(ci.MessageId)
+			},
+			SetValue: func(s string) {
+				ci.MessageId, _ = strconv.Atoi(s)
+			},
+		},
 		{
 			Key: fmt.Sprintf("/ci/%s/%d/file_id", ci.ChunkFileId, ci.Idx),
 			GetValue: func() string {
+				if ci.FileId == nil {
+					return ""
+				}
 				return *ci.FileId
 			},
 			SetValue: func(s string) {
-				ci.FileId = &s
+				// holes are stored without a file id
+				if s == "" {
+					ci.FileId = nil
+				} else {
+					ci.FileId = &s
+				}
+			},
+		},
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/ci/%s/%d/sha256", ci.ChunkFileId, ci.Idx),
+			GetValue: func() string {
+				return ci.Sha256
+			},
+			SetValue: func(s string) {
+				ci.Sha256 = s
+			},
+		}),
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/ci/%s/%d/codec", ci.ChunkFileId, ci.Idx),
+			GetValue: func() string {
+				return ci.Codec
+			},
+			SetValue: func(s string) {
+				ci.Codec = s
+			},
+		}),
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/ci/%s/%d/compressed_size", ci.ChunkFileId, ci.Idx),
+			GetValue: func() string {
+				return strconv.Itoa(ci.CompressedSize)
+			},
+			SetValue: func(s string) {
+				ci.CompressedSize, _ = strconv.Atoi(s)
+			},
+		}),
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/ci/%s/%d/content_hash", ci.ChunkFileId, ci.Idx),
+			GetValue: func() string {
+				return ci.ContentHash
+			},
+			SetValue: func(s string) {
+				ci.ContentHash = s
+			},
+		}),
+	}
+}
+
+func (kd *KeyedDirectory) GetKeyParams() []KeyParam {
+	dir := kd.directory
+	params := []KeyParam{
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/dir/%s/name", dir.Id),
+			GetValue: func() string {
+				return dir.Name
+			},
+			SetValue: func(s string) {
+				dir.Name = s
+			},
+		}),
+		{
+			Key: fmt.Sprintf("/dir/%s/parent", dir.Id),
+			GetValue: func() string {
+				return dir.ParentId
+			},
+			SetValue: func(s string) {
+				dir.ParentId = s
+			},
+		},
+	}
+	return append(params, sealAll(attributesKeyParams(fmt.Sprintf("/dir/%s", dir.Id), &dir.Attributes))...)
+}
+
+func (kl *KeyedLink) GetKeyParams() []KeyParam {
+	link := kl.link
+	return []KeyParam{
+		{
+			Key: fmt.Sprintf("/ln/%s/file", link.Id),
+			GetValue: func() string {
+				return link.FileId
+			},
+			SetValue: func(s string) {
+				link.FileId = s
+			},
+		},
+		{
+			Key: fmt.Sprintf("/ln/%s/parent", link.Id),
+			GetValue: func() string {
+				return link.ParentId
+			},
+			SetValue: func(s string) {
+				link.ParentId = s
 			},
 		},
+		sealed(KeyParam{
+			Key: fmt.Sprintf("/ln/%s/name", link.Id),
+			GetValue: func() string {
+				return link.Name
+			},
+			SetValue: func(s string) {
+				link.Name = s
+			},
+		}),
 	}
 }
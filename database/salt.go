@@ -0,0 +1,34 @@
+package db
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const saltKey = "/config/kdf_salt"
+
+func (e *etcdClient) KdfSalt(salt []byte) ([]byte, error) {
+	cli, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the first mount stores its salt, the others read it
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(saltKey), "=", 0)).
+		Then(clientv3.OpPut(saltKey, hex.EncodeToString(salt))).
+		Else(clientv3.OpGet(saltKey)).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Succeeded {
+		return salt, nil
+	}
+	return hex.DecodeString(string(resp.Responses[0].GetResponseRange().Kvs[0].Value))
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/encryption"
+	"it.smaso/tgfuse/filesystem"
+	"it.smaso/tgfuse/logger"
+)
+
+// sealed makes the value of param stored encrypted when ENCRYPT_METADATA is
+// set. Values are opened whenever they are encrypted, so that trees written
+// with the option either on or off can be read
+func sealed(param KeyParam) KeyParam {
+	setValue := param.SetValue
+	param.Sealed = true
+	param.SetValue = func(s string) {
+		setValue(openValue(param.Key, s))
+	}
+	return param
+}
+
+func sealAll(params []KeyParam) []KeyParam {
+	for idx := range params {
+		params[idx] = sealed(params[idx])
+	}
+	return params
+}
+
+// sealValue encrypts the value stored under key if metadata must be encrypted
+func sealValue(key, value string) (string, error) {
+	if !configs.ENCRYPT_METADATA {
+		return value, nil
+	}
+	metadataKey, err := encryption.MetadataKey()
+	if err == nil {
+		value, err = encryption.SealValue(metadataKey, key, value)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// openValue decrypts the value stored under key. Values that can't be
+// decrypted are kept as they are, so that files are still listed under their
+// encrypted names
+func openValue(key, value string) string {
+	if !encryption.IsSealedValue(value) {
+		return value
+	}
+	metadataKey, err := encryption.MetadataKey()
+	if err == nil {
+		var plain string
+		if plain, err = encryption.OpenValue(metadataKey, key, value); err == nil {
+			return plain
+		}
+	}
+	logger.LogWarn(fmt.Sprintf("Failed to decrypt %s: %s", key, err.Error()))
+	return value
+}
+
+// hashedNamePrefix marks the extended attributes stored under the keyed hash of
+// their name, which is sealed in the value. Real names always start with their
+// namespace, so they can't clash
+const hashedNamePrefix = "hmac:"
+
+// xattrParam returns where the extended attribute name of the file is stored.
+// When metadata is encrypted the name is hidden in the value too
+func xattrParam(cf *filesystem.ChunkFile, name string, value []byte) KeyParam {
+	param := KeyParam{
+		Key: xattrKey(cf.Id, name),
+		GetValue: func() string {
+			return string(value)
+		},
+		SetValue: func(s string) {
+			cf.SetXattr(name, []byte(s))
+		},
+	}
+	if configs.ENCRYPT_METADATA {
+		hashed, err := hashedName(name)
+		param.Key, param.Err = xattrKey(cf.Id, hashed), err
+		param.GetValue = func() string {
+			return name + "\x00" + string(value)
+		}
+	}
+	return sealed(param)
+}
+
+func hashedName(name string) (string, error) {
+	hash, err := encryption.IndexHash()
+	if err != nil {
+		return "", err
+	}
+	hash.Write([]byte(name))
+	return hashedNamePrefix + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// openXattr returns the name and the value of the extended attribute stored
+// under the given name
+func openXattr(key, name, value string) (string, string, error) {
+	value = openValue(key, value)
+	if !strings.HasPrefix(name, hashedNamePrefix) {
+		return name, value, nil
+	}
+	name, value, found := strings.Cut(value, "\x00")
+	if !found {
+		return "", "", fmt.Errorf("%s has no name, the master key may be wrong", key)
+	}
+	return name, value, nil
+}
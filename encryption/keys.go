@@ -0,0 +1,162 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"it.smaso/tgfuse/configs"
+)
+
+const (
+	// KEY_SIZE is the size of the master and data keys, used with AES-256
+	KEY_SIZE = 32
+	// SALT_SIZE is the size of the random salt generated for the passphrase
+	SALT_SIZE = 16
+)
+
+// ErrNoMasterKey is returned when an encrypted file is accessed by a mount
+// without a master key
+var ErrNoMasterKey = errors.New("no master key configured")
+
+// ErrNoSalt is returned when the key is derived from a passphrase but there's
+// neither a configured salt nor a store to keep a random one
+var ErrNoSalt = errors.New("no salt for the passphrase, set ENCRYPTION_SALT")
+
+// SaltStore keeps the salt of the passphrase, shared by every mount
+type SaltStore interface {
+	// KdfSalt returns the stored salt, storing salt first when there's none
+	KdfSalt(salt []byte) ([]byte, error)
+}
+
+var salts SaltStore
+
+// SetSaltStore keeps the salt of the passphrase in store, unless
+// ENCRYPTION_SALT is set. Must be called before the master key is loaded
+func SetSaltStore(store SaltStore) {
+	salts = store
+}
+
+var master struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+// Enabled tells whether new files are encrypted
+func Enabled() bool {
+	return configs.ENCRYPTION_KEY_FILE != "" || configs.ENCRYPTION_PASSPHRASE != ""
+}
+
+// MasterKey returns the key wrapping the data keys of the files. It's read from
+// ENCRYPTION_KEY_FILE, or derived from ENCRYPTION_PASSPHRASE when there's none
+func MasterKey() ([]byte, error) {
+	master.once.Do(func() {
+		master.key, master.err = loadMasterKey()
+	})
+	return master.key, master.err
+}
+
+func loadMasterKey() ([]byte, error) {
+	switch {
+	case configs.ENCRYPTION_KEY_FILE != "":
+		data, err := os.ReadFile(configs.ENCRYPTION_KEY_FILE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %s", err.Error())
+		}
+		if len(data) == KEY_SIZE {
+			return data, nil
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != KEY_SIZE {
+			return nil, fmt.Errorf("key file must contain %d bytes, raw or hex encoded", KEY_SIZE)
+		}
+		return key, nil
+	case configs.ENCRYPTION_PASSPHRASE != "":
+		salt, err := kdfSalt()
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(sha256.New, configs.ENCRYPTION_PASSPHRASE, salt, configs.ENCRYPTION_KDF_ITERATIONS, KEY_SIZE)
+	default:
+		return nil, ErrNoMasterKey
+	}
+}
+
+// kdfSalt returns the configured salt, or the random one generated by the
+// first mount deriving the key
+func kdfSalt() ([]byte, error) {
+	if configs.ENCRYPTION_SALT != "" {
+		return []byte(configs.ENCRYPTION_SALT), nil
+	}
+	if salts == nil {
+		return nil, ErrNoSalt
+	}
+	salt := make([]byte, SALT_SIZE)
+	rand.Read(salt)
+	salt, err := salts.KdfSalt(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load salt: %s", err.Error())
+	}
+	return salt, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewDataKey returns a random data key together with its wrapped form, to be
+// stored. The key is bound to id, so that it can't be moved to another file
+func NewDataKey(id string) ([]byte, string, error) {
+	masterKey, err := MasterKey()
+	if err != nil {
+		return nil, "", err
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := make([]byte, KEY_SIZE)
+	rand.Read(key)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+
+	wrapped := gcm.Seal(nonce, nonce, key, []byte(id))
+	return key, base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// UnwrapKey returns the data key of the file with the given id
+func UnwrapKey(wrapped, id string) ([]byte, error) {
+	masterKey, err := MasterKey()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed data key")
+	}
+	key, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key, the master key may be wrong")
+	}
+	return key, nil
+}
@@ -0,0 +1,95 @@
+package encryption
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"strings"
+	"sync"
+)
+
+// sealedPrefix marks the values stored encrypted, so that they can be told from
+// the ones stored before metadata was encrypted
+const sealedPrefix = "enc1:"
+
+var metadata struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+// MetadataKey returns the key encrypting the metadata of the files, derived
+// from the master key
+func MetadataKey() ([]byte, error) {
+	metadata.once.Do(func() {
+		masterKey, err := MasterKey()
+		if err != nil {
+			metadata.err = err
+			return
+		}
+		metadata.key, metadata.err = hkdf.Key(sha256.New, masterKey, nil, "tgfuse metadata", KEY_SIZE)
+	})
+	return metadata.key, metadata.err
+}
+
+var index struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+// IndexHash returns a hash keyed by a key derived from the master key, so that
+// content and names can be indexed in the database without being exposed
+func IndexHash() (hash.Hash, error) {
+	index.once.Do(func() {
+		masterKey, err := MasterKey()
+		if err != nil {
+			index.err = err
+			return
+		}
+		index.key, index.err = hkdf.Key(sha256.New, masterKey, nil, "tgfuse index", KEY_SIZE)
+	})
+	if index.err != nil {
+		return nil, index.err
+	}
+	return hmac.New(sha256.New, index.key), nil
+}
+
+// IsSealedValue tells whether value was encrypted by SealValue
+func IsSealedValue(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// SealValue encrypts the value stored under name. The name is authenticated
+// too, so that values can't be swapped between keys. The result has no
+// slashes, so that it can still be shown as a filename
+func SealValue(key []byte, name, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// OpenValue decrypts the value stored under name by SealValue
+func OpenValue(key []byte, name, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", ErrMalformed
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", ErrMalformed
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,157 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted content starts with a header, made of the format version and of a
+// random nonce prefix, followed by the content split in segments of
+// SEGMENT_SIZE bytes, each sealed with AES-GCM. The nonce of a segment is the
+// prefix, the segment counter and a flag marking the last segment, so that
+// segments can't be reordered nor the content truncated. Every segment is bound
+// to the additional data given by the caller, so that content can't be swapped
+// with the one sealed for another place. Segments let the content be encrypted
+// while it's streamed. Content of version 1 has no additional data.
+
+const (
+	SEGMENT_SIZE = 64 << 10
+
+	tagSize = 16 // overhead of AES-GCM on every segment
+
+	formatVersion = 2
+	legacyVersion = 1 // segments sealed without additional data
+	prefixSize    = 7
+	headerSize    = 1 + prefixSize
+)
+
+// ErrMalformed is returned when opening content that was not sealed or that
+// was changed afterwards
+var ErrMalformed = errors.New("malformed or tampered encrypted content")
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, prefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if last {
+		nonce[prefixSize+4] = 1
+	}
+	return nonce
+}
+
+// sealer encrypts the content of src one segment at a time
+type sealer struct {
+	gcm      cipher.AEAD
+	src      io.Reader
+	prefix   []byte
+	aad      []byte
+	counter  uint32
+	segment  []byte
+	carry    []byte // first byte of the next segment, read to find the last one
+	out      []byte // sealed bytes not read yet
+	started  bool
+	finished bool
+	err      error
+}
+
+// Seal returns a reader of the encrypted content of plain, bound to aad
+func Seal(key []byte, plain io.Reader, aad []byte) (io.Reader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, prefixSize)
+	rand.Read(prefix)
+	return &sealer{
+		gcm:     gcm,
+		src:     plain,
+		prefix:  prefix,
+		aad:     aad,
+		segment: make([]byte, SEGMENT_SIZE+1),
+	}, nil
+}
+
+func (s *sealer) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.fill()
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// fill puts the header or the next sealed segment in out
+func (s *sealer) fill() {
+	if !s.started {
+		s.started = true
+		s.out = append([]byte{formatVersion}, s.prefix...)
+		return
+	}
+	if s.finished {
+		s.err = io.EOF
+		return
+	}
+
+	n := copy(s.segment, s.carry)
+	read, err := io.ReadFull(s.src, s.segment[n:])
+	n += read
+	switch err {
+	case nil:
+		s.carry = append(s.carry[:0], s.segment[SEGMENT_SIZE])
+		n = SEGMENT_SIZE
+	case io.EOF, io.ErrUnexpectedEOF:
+		s.finished = true
+	default:
+		s.err = err
+		return
+	}
+
+	s.out = s.gcm.Seal(nil, segmentNonce(s.prefix, s.counter, s.finished), s.segment[:n], s.aad)
+	s.counter++
+}
+
+// SealedSize returns the size of size bytes once sealed
+func SealedSize(size int) int {
+	segments := max(1, (size+SEGMENT_SIZE-1)/SEGMENT_SIZE)
+	return headerSize + size + segments*tagSize
+}
+
+// Open returns the content sealed in data, which must be bound to aad
+func Open(key, data, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize {
+		return nil, ErrMalformed
+	}
+	switch data[0] {
+	case formatVersion:
+	case legacyVersion:
+		aad = nil
+	default:
+		return nil, ErrMalformed
+	}
+	prefix, rest := data[1:headerSize], data[headerSize:]
+
+	sealedSize := SEGMENT_SIZE + gcm.Overhead()
+	plain := make([]byte, 0, len(rest))
+	for counter := uint32(0); ; counter++ {
+		size := min(len(rest), sealedSize)
+		last := size == len(rest)
+		plain, err = gcm.Open(plain, segmentNonce(prefix, counter, last), rest[:size], aad)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		if last {
+			return plain, nil
+		}
+		rest = rest[size:]
+	}
+}
@@ -0,0 +1,140 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func seal(t *testing.T, key, plain, aad []byte) []byte {
+	t.Helper()
+	reader, err := Seal(key, bytes.NewReader(plain), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestSealOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "single byte", size: 1},
+		{name: "one byte short of a segment", size: SEGMENT_SIZE - 1},
+		{name: "exactly one segment", size: SEGMENT_SIZE},
+		{name: "one byte past a segment", size: SEGMENT_SIZE + 1},
+		{name: "exactly two segments", size: 2 * SEGMENT_SIZE},
+		{name: "several segments and a tail", size: 3*SEGMENT_SIZE + 5},
+	}
+
+	key := make([]byte, KEY_SIZE)
+	rand.Read(key)
+	aad := []byte("file/0")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := make([]byte, tt.size)
+			rand.Read(plain)
+
+			sealed := seal(t, key, plain, aad)
+			if size := SealedSize(tt.size); size != len(sealed) {
+				t.Errorf("SealedSize() = %d, want %d", size, len(sealed))
+			}
+			got, err := Open(key, sealed, aad)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("Open() returned %d bytes, different from the %d sealed", len(got), len(plain))
+			}
+		})
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	key := make([]byte, KEY_SIZE)
+	rand.Read(key)
+	otherKey := make([]byte, KEY_SIZE)
+	rand.Read(otherKey)
+	aad := []byte("file/0")
+
+	plain := make([]byte, 2*SEGMENT_SIZE)
+	rand.Read(plain)
+	sealed := seal(t, key, plain, aad)
+	segment := SEGMENT_SIZE + tagSize
+
+	tests := []struct {
+		name string
+		key  []byte
+		data []byte
+		aad  []byte
+	}{
+		{
+			name: "truncated at a segment boundary",
+			key:  key,
+			data: sealed[:headerSize+segment],
+			aad:  aad,
+		},
+		{
+			name: "truncated inside a segment",
+			key:  key,
+			data: sealed[:len(sealed)-1],
+			aad:  aad,
+		},
+		{
+			name: "header only",
+			key:  key,
+			data: sealed[:headerSize],
+			aad:  aad,
+		},
+		{
+			name: "shorter than the header",
+			key:  key,
+			data: sealed[:headerSize-1],
+			aad:  aad,
+		},
+		{
+			name: "sealed for another chunk",
+			key:  key,
+			data: sealed,
+			aad:  []byte("file/1"),
+		},
+		{
+			name: "wrong key",
+			key:  otherKey,
+			data: sealed,
+			aad:  aad,
+		},
+		{
+			name: "tampered segment",
+			key:  key,
+			data: func() []byte {
+				data := bytes.Clone(sealed)
+				data[headerSize+10] ^= 1
+				return data
+			}(),
+			aad: aad,
+		},
+		{
+			name: "unknown version",
+			key:  key,
+			data: append([]byte{formatVersion + 1}, sealed[1:]...),
+			aad:  aad,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(tt.key, tt.data, tt.aad); !errors.Is(err, ErrMalformed) {
+				t.Errorf("Open() error = %v, want %v", err, ErrMalformed)
+			}
+		})
+	}
+}
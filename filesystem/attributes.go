@@ -0,0 +1,37 @@
+package filesystem
+
+import "time"
+
+// Attributes contains the permissions, ownership and timestamps of a file or a
+// directory of the tree
+type Attributes struct {
+	Mode  uint32 // permission bits only, the file type is implied by the entry
+	Uid   uint32
+	Gid   uint32
+	Atime time.Time
+	Mtime time.Time
+	Ctime time.Time
+}
+
+func NewAttributes(mode, uid, gid uint32) Attributes {
+	now := time.Now()
+	return Attributes{
+		Mode:  mode & 0o7777,
+		Uid:   uid,
+		Gid:   gid,
+		Atime: now,
+		Mtime: now,
+		Ctime: now,
+	}
+}
+
+// Modified records a change of the content
+func (a *Attributes) Modified() {
+	a.Mtime = time.Now()
+	a.Ctime = a.Mtime
+}
+
+// Changed records a change of the attributes only
+func (a *Attributes) Changed() {
+	a.Ctime = time.Now()
+}
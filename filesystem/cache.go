@@ -0,0 +1,235 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/logger"
+)
+
+// The downloaded chunks of a file are kept in CACHE_FOLDER/<id>, at the offset
+// of the chunk, and survive remounts. Since chunks are downloaded in any order,
+// CACHE_FOLDER/<id>.bitmap records which ones are present. Along with the bit,
+// the telegram file id and the range of the chunk are kept, so that a chunk
+// replaced by another mount, or moved by a new cut of the file, is not served
+// from the cache. The digest of the content is kept too, and checked when the
+// chunks are loaded, so that content lost by a crash is downloaded again.
+
+// cacheBitmap is the persisted form of the chunks present in a cache file
+type cacheBitmap struct {
+	Present []byte
+	FileIds []string
+	Starts  []int64
+	Ends    []int64
+	Sums    []string // hex digests of the plain content
+}
+
+func cachePath(cfId string) string {
+	return path.Join(configs.CACHE_FOLDER, cfId)
+}
+
+func bitmapPath(cfId string) string {
+	return cachePath(cfId) + ".bitmap"
+}
+
+// openCache returns the cache file of the file with the given id, or nil if
+// there's none. A cache file without a bitmap is kept, with no chunk present
+func openCache(cfId string) *temporaryFile {
+	name := cachePath(cfId)
+	if _, err := os.Stat(name); err != nil {
+		return nil
+	}
+
+	tf := &temporaryFile{name: name}
+	data, err := os.ReadFile(bitmapPath(cfId))
+	if err == nil {
+		err = json.Unmarshal(data, &tf.bitmap)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.LogWarn(fmt.Sprintf("Ignoring cache bitmap of %s: %s", cfId, err.Error()))
+		tf.bitmap = cacheBitmap{}
+	}
+	return tf
+}
+
+// has tells whether the content of the chunk is in the file
+func (tf *temporaryFile) has(ci *ChunkItem) bool {
+	if ci.FileId == nil {
+		return false
+	}
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	byteIdx, bit := ci.Idx/8, byte(1)<<(ci.Idx%8)
+	if byteIdx >= len(tf.bitmap.Present) || tf.bitmap.Present[byteIdx]&bit == 0 {
+		return false
+	}
+	if ci.Idx >= len(tf.bitmap.FileIds) || ci.Idx >= len(tf.bitmap.Starts) || ci.Idx >= len(tf.bitmap.Ends) {
+		return false
+	}
+	return tf.bitmap.FileIds[ci.Idx] == *ci.FileId &&
+		tf.bitmap.Starts[ci.Idx] == ci.Start && tf.bitmap.Ends[ci.Idx] == ci.End
+}
+
+// bitmapFlushDelay is how long the bitmap of a cache file waits for more chunks
+// to be marked present before being written
+const bitmapFlushDelay = time.Second
+
+// contentSum returns the digest of the plain content of a chunk, as recorded in
+// the bitmap
+func contentSum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// markPresent records that the content of the chunk, whose digest is sum, was
+// written to the file. The bitmap is written once no chunk is added for
+// bitmapFlushDelay, after the file is synced, so that a crash can't leave the
+// bit set without the content. A crash before then only loses cached chunks
+func (tf *temporaryFile) markPresent(ci *ChunkItem, sum string) {
+	if ci.FileId == nil {
+		return
+	}
+
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	byteIdx, bit := ci.Idx/8, byte(1)<<(ci.Idx%8)
+	for len(tf.bitmap.Present) <= byteIdx {
+		tf.bitmap.Present = append(tf.bitmap.Present, 0)
+	}
+	for len(tf.bitmap.FileIds) <= ci.Idx {
+		tf.bitmap.FileIds = append(tf.bitmap.FileIds, "")
+	}
+	for len(tf.bitmap.Starts) <= ci.Idx {
+		tf.bitmap.Starts = append(tf.bitmap.Starts, 0)
+	}
+	for len(tf.bitmap.Ends) <= ci.Idx {
+		tf.bitmap.Ends = append(tf.bitmap.Ends, 0)
+	}
+	for len(tf.bitmap.Sums) <= ci.Idx {
+		tf.bitmap.Sums = append(tf.bitmap.Sums, "")
+	}
+	tf.bitmap.Present[byteIdx] |= bit
+	tf.bitmap.FileIds[ci.Idx] = *ci.FileId
+	tf.bitmap.Starts[ci.Idx] = ci.Start
+	tf.bitmap.Ends[ci.Idx] = ci.End
+	tf.bitmap.Sums[ci.Idx] = sum
+
+	if tf.flush == nil {
+		tf.flush = time.AfterFunc(bitmapFlushDelay, func() {
+			tf.lock.Lock()
+			defer tf.lock.Unlock()
+			// the bitmap was written or the file removed in the meantime
+			if tf.flush != nil {
+				tf.writeBitmap()
+			}
+		})
+	} else {
+		tf.flush.Reset(bitmapFlushDelay)
+	}
+}
+
+// verify tells whether the cached content of the chunk matches the digest
+// recorded with it. The chunk is marked absent when it doesn't
+func (tf *temporaryFile) verify(ci *ChunkItem) bool {
+	tf.lock.Lock()
+	var sum string
+	if ci.Idx < len(tf.bitmap.Sums) {
+		sum = tf.bitmap.Sums[ci.Idx]
+	}
+	tf.lock.Unlock()
+
+	hash := sha256.New()
+	_, err := io.Copy(hash, io.NewSectionReader(tf.getFile(), ci.Start, int64(ci.Size)))
+	if err == nil && sum != "" && hex.EncodeToString(hash.Sum(nil)) == sum {
+		return true
+	}
+	logger.LogWarn(fmt.Sprintf("Cached chunk [%d] of %s doesn't match its digest, dropping it", ci.Idx, path.Base(tf.name)))
+	tf.markAbsent(ci)
+	return false
+}
+
+// markAbsent records that the content of the chunk was dropped from the file.
+// The bitmap is written right away, since the range is reused afterwards
+func (tf *temporaryFile) markAbsent(ci *ChunkItem) {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+
+	byteIdx, bit := ci.Idx/8, byte(1)<<(ci.Idx%8)
+	if byteIdx >= len(tf.bitmap.Present) || tf.bitmap.Present[byteIdx]&bit == 0 {
+		return
+	}
+	tf.bitmap.Present[byteIdx] &^= bit
+	tf.writeBitmap()
+}
+
+// writeBitmap stores the bitmap, cancelling the pending write if any. The
+// chunks marked present since the last write are synced first. Must be called
+// holding lock
+func (tf *temporaryFile) writeBitmap() {
+	var err error
+	if tf.flush != nil {
+		tf.flush.Stop()
+		tf.flush = nil
+		err = tf.getFile().Sync()
+	}
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(tf.bitmap)
+	}
+	if err == nil {
+		err = writeDurable(tf.name+".bitmap", data)
+	}
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to write cache bitmap of %s: %s", path.Base(tf.name), err.Error()))
+	}
+}
+
+// remove deletes the file together with its bitmap
+func (tf *temporaryFile) remove() error {
+	tf.lock.Lock()
+	if tf.flush != nil {
+		tf.flush.Stop()
+		tf.flush = nil
+	}
+	tf.lock.Unlock()
+
+	if tf.handle != nil {
+		tf.handle.Close()
+	}
+	if err := os.Remove(tf.name + ".bitmap"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Remove(tf.name)
+}
+
+// PruneCache deletes the cache of the files for which keep returns false, to be
+// called with the files known on startup since deletions happened elsewhere
+// can't be noticed otherwise
+func PruneCache(keep func(cfId string) bool) {
+	entries, err := os.ReadDir(configs.CACHE_FOLDER)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to read cache dir: %s", err.Error()))
+		return
+	}
+	for _, entry := range entries {
+		cfId := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".tmp"), ".bitmap")
+		if keep(cfId) {
+			continue
+		}
+		if err := os.Remove(path.Join(configs.CACHE_FOLDER, entry.Name())); err != nil {
+			logger.LogWarn(fmt.Sprintf("Failed to delete stale cache file %s: %s", entry.Name(), err.Error()))
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package filesystem
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/logger"
+)
+
+// cacheEntry is a chunk whose content is in the cache file or in memory
+type cacheEntry struct {
+	cf   *ChunkFile
+	ci   *ChunkItem
+	size int64
+}
+
+// cacheManager keeps the chunks held locally within CACHE_MAX_BYTES, evicting
+// the least recently used ones. Chunks of pinned files are never evicted
+type cacheManager struct {
+	lock    sync.Mutex
+	lru     *list.List // most recently used first
+	entries map[*ChunkItem]*list.Element
+	used    int64
+	evict   chan struct{}
+	start   sync.Once
+	pinned  func(cf *ChunkFile) bool
+}
+
+var cache = &cacheManager{
+	lru:     list.New(),
+	entries: map[*ChunkItem]*list.Element{},
+	evict:   make(chan struct{}, 1),
+	pinned: func(cf *ChunkFile) bool {
+		return IsPinned(cf.Id)
+	},
+}
+
+// SetPinResolver replaces the check telling whether a file is pinned, so that
+// the directories containing the file can be taken into account
+func SetPinResolver(pinned func(cf *ChunkFile) bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.pinned = pinned
+}
+
+// CacheUsage returns the bytes of the chunks held locally
+func CacheUsage() int64 {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.used
+}
+
+// touch records the use of a chunk held locally, adding it if needed
+func (m *cacheManager) touch(cf *ChunkFile, ci *ChunkItem) {
+	m.start.Do(func() {
+		go m.evictLoop()
+	})
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if elem, found := m.entries[ci]; found {
+		m.lru.MoveToFront(elem)
+		return
+	}
+	m.entries[ci] = m.lru.PushFront(&cacheEntry{cf: cf, ci: ci, size: int64(ci.Size)})
+	m.used += int64(ci.Size)
+
+	if m.used > int64(configs.CACHE_MAX_BYTES) {
+		select {
+		case m.evict <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// forget stops tracking a chunk whose content was dropped or is being changed
+func (m *cacheManager) forget(ci *ChunkItem) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if elem, found := m.entries[ci]; found {
+		m.used -= elem.Value.(*cacheEntry).size
+		m.lru.Remove(elem)
+		delete(m.entries, ci)
+	}
+}
+
+func (m *cacheManager) evictLoop() {
+	for range m.evict {
+		for m.overBudget() {
+			if !m.evictOne() {
+				logger.LogWarn(fmt.Sprintf("Cache holds %d bytes over its budget, the rest is pinned or in use", m.overflow()))
+				break
+			}
+		}
+	}
+}
+
+func (m *cacheManager) overBudget() bool {
+	return m.overflow() > 0
+}
+
+func (m *cacheManager) overflow() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used - int64(configs.CACHE_MAX_BYTES)
+}
+
+// evictOne drops the least recently used chunk that is not pinned nor busy,
+// returning false if there's none. Pinned chunks met on the way are moved to
+// the front, so that the next evictions don't go through them again
+func (m *cacheManager) evictOne() bool {
+	m.lock.Lock()
+	pinned := m.pinned
+	remaining := m.lru.Len()
+	elem := m.lru.Back()
+	m.lock.Unlock()
+
+	for ; elem != nil && remaining > 0; remaining-- {
+		entry := elem.Value.(*cacheEntry)
+		// pins are checked without holding lock, since looking at the
+		// directories containing the file waits for the tree
+		isPinned := pinned(entry.cf)
+
+		m.lock.Lock()
+		if m.entries[entry.ci] != elem {
+			// the chunk was dropped or used in the meantime
+			elem = m.lru.Back()
+			m.lock.Unlock()
+			continue
+		}
+		next := elem.Prev()
+		if isPinned {
+			m.lru.MoveToFront(elem)
+		}
+		m.lock.Unlock()
+
+		if isPinned || !entry.ci.lock.TryLock() {
+			elem = next
+			continue
+		}
+		m.forget(entry.ci)
+		entry.cf.evictChunk(entry.ci)
+		entry.ci.lock.Unlock()
+		return true
+	}
+	return false
+}
+
+// spillOne moves the buffer of the least recently used chunk held in memory to
+// the disk cache, returning false if there's none that is not busy
+func (m *cacheManager) spillOne() bool {
+	m.lock.Lock()
+	candidates := []*cacheEntry{}
+	for elem := m.lru.Back(); elem != nil; elem = elem.Prev() {
+		if entry := elem.Value.(*cacheEntry); entry.ci.FileState == MEMORY {
+			candidates = append(candidates, entry)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, entry := range candidates {
+		if !entry.ci.lock.TryLock() {
+			continue
+		}
+		spilled := entry.cf.spillChunk(entry.ci)
+		entry.ci.lock.Unlock()
+		if spilled {
+			return true
+		}
+	}
+	return false
+}
+
+// spillChunk writes the buffer of the chunk to the disk cache and frees it. If
+// there's no cache file the buffer is dropped, since the chunk can be downloaded
+// again. Must be called holding the lock of the chunk
+func (cf *ChunkFile) spillChunk(ci *ChunkItem) bool {
+	if ci.FileState != MEMORY || ci.Buf == nil || ci.Dirty {
+		return false
+	}
+
+	ci.FileState = UPLOADED
+	if err := cf.ensureTmpFile(); err == nil {
+		if _, err := cf.tmpFile.getFile().WriteAt(ci.Buf.Bytes(), ci.Start); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to spill chunk [%d] to tmp file: %s", ci.Idx, err.Error()))
+		} else {
+			cf.tmpFile.markPresent(ci, contentSum(ci.Buf.Bytes()))
+			ci.FileState = FILE
+		}
+	}
+	if ci.FileState != FILE {
+		cache.forget(ci)
+	}
+	ci.dropBuf()
+	return true
+}
+
+// evictChunk drops the local content of the chunk, which is downloaded again
+// when needed. Must be called holding the lock of the chunk
+func (cf *ChunkFile) evictChunk(ci *ChunkItem) {
+	if ci.Dirty {
+		return
+	}
+	switch ci.FileState {
+	case MEMORY:
+		ci.dropBuf()
+		ci.FileState = UPLOADED
+	case FILE:
+		cf.tmpFileLock.Lock()
+		defer cf.tmpFileLock.Unlock()
+		if cf.tmpFile == nil {
+			return
+		}
+		cf.tmpFile.markAbsent(ci)
+		if err := punchHole(cf.tmpFile.getFile(), ci.Start, int64(ci.Size)); err != nil {
+			logger.LogWarn(fmt.Sprintf("Failed to free cache of chunk [%d] of %s: %s", ci.Idx, cf.OriginalFilename, err.Error()))
+		}
+		ci.FileState = UPLOADED
+	}
+	logger.LogInfo(fmt.Sprintf("Evicted chunk [%d] of %s from cache", ci.Idx, cf.OriginalFilename))
+}
@@ -3,11 +3,15 @@ package filesystem
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"slices"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,20 +19,24 @@ import (
 	"it.smaso/tgfuse/configs"
 	"it.smaso/tgfuse/filesystem/atime"
 	"it.smaso/tgfuse/logger"
+	"it.smaso/tgfuse/telegram"
 )
 
-// temporaryFile represents the temporary file containing the
+// temporaryFile represents the cache file containing the downloaded chunks,
+// see openCache
 type temporaryFile struct {
-	name           string
-	handle         *os.File
-	bytesAvailable int64 // contains the number of available bytes counting from 0
+	name   string
+	handle *os.File
+	lock   sync.Mutex
+	bitmap cacheBitmap // chunks present in the file
+	flush  *time.Timer // pending write of the bitmap, see markPresent
 }
 
 func (tf *temporaryFile) getFile() *os.File {
 	if tf.handle != nil {
 		return tf.handle
 	}
-	h, err := os.Open(tf.name)
+	h, err := os.OpenFile(tf.name, os.O_RDWR, 0o644)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to open existing temporary file: %s", err.Error()))
 	}
@@ -55,14 +63,37 @@ type ChunkFileOpt = func(*ChunkFile)
 type ChunkFile struct {
 	Ino              uint64
 	Id               string
+	ParentId         string
 	OriginalFilename string
 	OriginalSize     int
 	NumChunks        int
-	Chunks           []*ChunkItem
-	tmpFile          *temporaryFile
-	isDownloading    bool
-	readyMutex       sync.Mutex
-	readyToDownload  bool
+	Nlink            int      // number of names of the file, see Link
+	SymlinkTarget    string   // set only when the file is a symbolic link
+	ManifestHash     string   // digest of the list of uploaded chunks, see manifestHash
+	WrappedKey       string   // data key of the chunks wrapped by the master key, empty when not encrypted
+	Chunking         Chunking // strategy cutting the content, see ChunkingStrategy
+	Attributes
+	Chunks          []*ChunkItem
+	tmpFile         *temporaryFile
+	tmpFileLock     sync.Mutex
+	readyMutex      sync.Mutex
+	readyToDownload bool
+
+	writeLock       sync.Mutex
+	metadataChanged bool           // the file attributes must be saved to the database
+	uploads         sync.WaitGroup // chunks queued for upload, see enqueueUpload
+	journalStale    bool           // the layout changed since it was journaled
+
+	changesLock   sync.Mutex
+	changedChunks []*ChunkItem // chunks uploaded but not yet saved to the database
+	staleMessages []remoteRef  // messages of the chunks replaced by a new upload
+	uploadErr     error        // last failed background upload, returned by the next save
+
+	xattrLock sync.RWMutex
+	xattrs    map[string][]byte
+
+	keyLock sync.Mutex
+	key     []byte // unwrapped data key, see dataKey
 }
 
 func NewChunkFile(opts ...ChunkFileOpt) *ChunkFile {
@@ -79,14 +110,7 @@ func NewChunkFile(opts ...ChunkFileOpt) *ChunkFile {
 func WithId(id string) func(*ChunkFile) {
 	return func(cf *ChunkFile) {
 		cf.Id = id
-
-		filepath := path.Join(configs.TMP_FILE_FOLDER, cf.Id)
-		if stat, err := os.Stat(filepath); err == nil {
-			cf.tmpFile = &temporaryFile{
-				name:           filepath,
-				bytesAvailable: stat.Size(),
-			}
-		}
+		cf.tmpFile = openCache(cf.Id)
 	}
 }
 
@@ -124,23 +148,98 @@ func (cf *ChunkFile) ReadyToClean() bool {
 }
 
 func (cf *ChunkFile) DeleteTmpFile() {
+	cf.tmpFileLock.Lock()
+	defer cf.tmpFileLock.Unlock()
+
 	if cf.tmpFile != nil {
-		if err := os.Remove(cf.tmpFile.name); err != nil {
+		if err := cf.tmpFile.remove(); err != nil {
 			logger.LogErr(fmt.Sprintf("Failed to delete temporary file %s: %s", cf.tmpFile.name, err.Error()))
 		}
 		cf.tmpFile = nil
 		for idx := range cf.Chunks {
 			ci := cf.Chunks[idx]
-			ci.FileState = UPLOADED
+			if ci.FileState == FILE {
+				ci.FileState = UPLOADED
+				cache.forget(ci)
+			}
 		}
 	}
 }
 
+// DiscardChanges deletes the spool files of the chunks that were not uploaded
+func (cf *ChunkFile) DiscardChanges() {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	for idx := range cf.Chunks {
+		ci := cf.Chunks[idx]
+		ci.lock.Lock()
+		ci.removeSpool()
+		ci.Dirty = false
+		ci.lock.Unlock()
+	}
+	cf.clearJournal()
+}
+
+// DeleteRemoteChunks releases every message backing the chunks of a deleted
+// file, including the ones replaced by uploads that were never saved
+func (cf *ChunkFile) DeleteRemoteChunks() {
+	for idx := range cf.Chunks {
+		ci := cf.Chunks[idx]
+		if err := ci.DeleteRemote(); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to delete chunk [%d] of %s from telegram: %s", ci.Idx, cf.OriginalFilename, err.Error()))
+		}
+	}
+
+	cf.changesLock.Lock()
+	stale := cf.staleMessages
+	cf.staleMessages = nil
+	cf.changesLock.Unlock()
+	releaseStale(stale)
+}
+
+// releaseStale releases the messages of the chunks replaced by a new upload
+func releaseStale(stale []remoteRef) {
+	for _, ref := range stale {
+		if err := releaseRemote(ref); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to delete replaced message %d: %s", ref.MessageId, err.Error()))
+		}
+	}
+}
+
+// HasBytes tells whether every chunk between start and end is in the cache
 func (cf *ChunkFile) HasBytes(start, end int64) bool {
-	if cf.tmpFile == nil {
-		return false
+	for idx := range cf.Chunks {
+		ci := cf.Chunks[idx]
+		if ci.End <= start || ci.Start >= end || ci.IsHole() {
+			continue
+		}
+		if !cf.IsCached(ci) {
+			return false
+		}
 	}
-	return cf.tmpFile.bytesAvailable >= end
+	return true
+}
+
+// IsCached tells whether the content of the chunk is in the cache
+func (cf *ChunkFile) IsCached(ci *ChunkItem) bool {
+	return cf.tmpFile != nil && cf.tmpFile.has(ci)
+}
+
+// LoadCached makes the chunk read from the cache if its content is there and
+// matches the digest recorded with it
+func (cf *ChunkFile) LoadCached(ci *ChunkItem) {
+	if ci.IsHole() || !cf.IsCached(ci) || !cf.tmpFile.verify(ci) {
+		return
+	}
+	ci.FileState = FILE
+	cache.touch(cf, ci)
+}
+
+// Prefetch starts the download of every chunk not held locally yet. Busy chunks
+// are skipped, and reads take precedence over these downloads
+func (cf *ChunkFile) Prefetch() error {
+	return cf.FetchRange(0, 0, len(cf.Chunks))
 }
 
 // ReadChunkFile reads a file given its path and creates its correspondent chunk file
@@ -164,26 +263,46 @@ func SplitBytes(filename string, fileBytes *[]byte) (*ChunkFile, error) {
 	if fileBytes == nil {
 		panic("fileBytes must not be nil")
 	}
+	// the chunks share the bytes of the file, accounted once split among them
+	if err := memory.reserve(context.Background(), int64(len(*fileBytes))); err != nil {
+		return nil, err
+	}
 
 	cf := ChunkFile{
 		OriginalFilename: filename,
 		OriginalSize:     len(*fileBytes),
 		Id:               uuid.NewString(),
+		Chunking:         configs.CHUNKING,
+	}
+
+	var sizes []int
+	if cf.Chunking == CDC {
+		sizes = cdcSplit(*fileBytes)
+	} else {
+		for chunk := range slices.Chunk(*fileBytes, configs.CHUNK_SIZE) {
+			sizes = append(sizes, len(chunk))
+		}
 	}
 
 	var ci []*ChunkItem
 	var count int = 0
-	for chunk := range slices.Chunk(*fileBytes, configs.CHUNK_SIZE) {
+	var start int64 = 0
+	for _, size := range sizes {
+		chunk := (*fileBytes)[start : start+int64(size)]
 		ci = append(ci, &ChunkItem{
 			Idx:         count,
 			Size:        len(chunk),
 			Name:        uuid.NewString(),
 			Buf:         bytes.NewBuffer(chunk),
+			bufSize:     int64(len(chunk)),
 			FileState:   MEMORY,
 			FileId:      nil,
 			ChunkFileId: cf.Id,
+			Start:       start,
+			End:         start + int64(size),
 		})
 		count++
+		start += int64(size)
 	}
 	cf.Chunks = ci
 	cf.NumChunks = count
@@ -191,63 +310,462 @@ func SplitBytes(filename string, fileBytes *[]byte) (*ChunkFile, error) {
 	return &cf, nil
 }
 
-// StartDownload locks and starts the download of all the chunks, if needed
-func (cf *ChunkFile) StartDownload(ctx context.Context) {
-	if cf.isDownloading {
-		return
+// chunkIndex returns the index of the chunk holding the byte at off, or the
+// number of chunks when off is past the end of the file
+func (cf *ChunkFile) chunkIndex(off int64) int {
+	chunks := cf.Chunks
+	return sort.Search(len(chunks), func(idx int) bool {
+		return chunks[idx].End > off
+	})
+}
+
+// FetchRange starts the download of the chunks covering the bytes between start
+// and end, followed by the next ahead chunks. The covering chunks are locked
+// before returning so that readers wait for them and their download takes
+// precedence over prefetching, chunks ahead that are busy are skipped instead
+func (cf *ChunkFile) FetchRange(start, end int64, ahead int) error {
+	if err := cf.ensureTmpFile(); err != nil {
+		return err
 	}
-	if cf.tmpFile != nil && cf.tmpFile.bytesAvailable == int64(cf.OriginalSize) {
+
+	for idx := range cf.Chunks {
+		ci := cf.Chunks[idx]
+		if ci.End <= start {
+			continue
+		}
+		if ci.Start >= end {
+			if ahead <= 0 {
+				break
+			}
+			ahead--
+			if ci.isDownloading.Load() || !ci.lock.TryLock() {
+				continue
+			}
+		} else {
+			// the chunk may be waiting for a slot as a prefetch
+			if ci.isDownloading.Load() {
+				ci.wanted.Store(true)
+				telegram.GetInstance().Reschedule()
+				continue
+			}
+			ci.lock.Lock()
+			ci.wanted.Store(true)
+		}
+		if !ci.shouldBeDownloaded() {
+			ci.wanted.Store(false)
+			ci.lock.Unlock()
+			continue
+		}
+
+		logger.LogInfo(fmt.Sprintf("Locked chunk [%d] to be downloaded", ci.Idx))
+		ci.isDownloading.Store(true)
+		go func(item *ChunkItem) {
+			defer item.lock.Unlock()
+			defer item.wanted.Store(false)
+			if err := item.fetchBuffer(cf); err != nil {
+				logger.LogErr(fmt.Sprintf("Failed to download chunk item [%d]: %s", item.Idx, err.Error()))
+			}
+			logger.LogInfo(fmt.Sprintf("Unlocked chunk [%d]", item.Idx))
+		}(ci)
+	}
+	return nil
+}
+
+// WriteAt writes data starting from the given offset. Only the chunks touched
+// by the write are loaded and marked as dirty, writing past the end of the file
+// grows the last chunk and appends new ones
+func (cf *ChunkFile) WriteAt(data []byte, off int64) (int, error) {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	if err := cf.initKey(); err != nil {
+		return 0, err
+	}
+	if cf.Chunking == "" && len(cf.Chunks) == 0 {
+		cf.Chunking = configs.CHUNKING
+	}
+	if off > int64(cf.OriginalSize) {
+		cf.grow(off)
+	}
+	cf.Modified()
+	cf.metadataChanged = true
+	defer cf.syncJournal()
+	return cf.writeAt(data, off)
+}
+
+// Truncate changes the size of the file. Shrinking drops the trailing chunks
+// and trims the last one, growing appends holes that are never uploaded
+func (cf *ChunkFile) Truncate(size int64) error {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	cf.Modified()
+	cf.metadataChanged = true
+	cf.journalStale = true
+	defer cf.syncJournal()
+
+	switch {
+	case size < int64(cf.OriginalSize):
+		return cf.shrink(size)
+	case size > int64(cf.OriginalSize):
+		cf.grow(size)
+	}
+	return nil
+}
+
+// UpdateAttributes applies update to the attributes of the file, which are
+// then stored on the next save. update returns whether something changed
+func (cf *ChunkFile) UpdateAttributes(update func(*Attributes) bool) bool {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	if !update(&cf.Attributes) {
+		return false
+	}
+	cf.Changed()
+	cf.metadataChanged = true
+	return true
+}
+
+// RefreshAttributes replaces the attributes and the link count with the ones
+// read from the database, unless the file has local changes that are not saved yet
+func (cf *ChunkFile) RefreshAttributes(attrs Attributes, nlink int) {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	if !cf.metadataChanged {
+		cf.Attributes = attrs
+		cf.Nlink = nlink
+	}
+}
+
+// ChunkingStrategy returns how the content of the file is cut in chunks. Files
+// stored before strategies could be chosen are cut by FIXED
+func (cf *ChunkFile) ChunkingStrategy() Chunking {
+	if cf.Chunking == "" {
+		return FIXED
+	}
+	return cf.Chunking
+}
+
+// SetChunking changes how the content written from now on is cut in chunks.
+// The chunks already stored keep their bounds
+func (cf *ChunkFile) SetChunking(strategy Chunking) {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	if cf.Chunking == strategy {
 		return
 	}
+	cf.Chunking = strategy
+	cf.metadataChanged = true
+	cf.journalStale = true
+	cf.syncJournal()
+}
 
-	cf.isDownloading = true
+func (cf *ChunkFile) IsSymlink() bool {
+	return cf.SymlinkTarget != ""
+}
 
-	wg := sync.WaitGroup{}
-	wg.Add(cf.NumChunks)
+// SetLinks changes the number of names of the file, updating its change time
+// unless ctime is given to restore a previous one
+func (cf *ChunkFile) SetLinks(nlink int, ctime *time.Time) {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
 
-	go func() {
-		for idx := range cf.Chunks {
-			select {
-			case <-ctx.Done():
-				cf.DeleteTmpFile()
-				logger.LogInfo("Stopped downloading chunks and deleted tmpfile")
-				return
-			default:
-				ci := cf.Chunks[idx]
-				if ci.shouldBeDownloaded() {
-					ci.lock.Lock()
-					wg.Done()
-					logger.LogInfo(fmt.Sprintf("Locked chunk [%d] to be downloaded", ci.Idx))
-					go func(item *ChunkItem) {
-						defer item.lock.Unlock()
-						if err := item.fetchBuffer(cf); err != nil {
-							logger.LogErr(fmt.Sprintf("Failed to download chunk item [%d]: %s", item.Idx, err.Error()))
-						}
-						logger.LogInfo(fmt.Sprintf("Unlocked chunk [%d]", item.Idx))
-					}(ci)
-				}
+	cf.Nlink = nlink
+	if ctime != nil {
+		cf.Ctime = *ctime
+	} else {
+		cf.Changed()
+	}
+}
+
+// Links returns the number of names of the file. Files stored before hard
+// links were supported have no link count and a single name
+func (cf *ChunkFile) Links() int {
+	return max(cf.Nlink, 1)
+}
+
+// Accessed updates the access time of the file. The change is kept in memory
+// until something else gets saved, so that reads don't write to the database
+func (cf *ChunkFile) Accessed() {
+	cf.Atime = time.Now()
+}
+
+func (cf *ChunkFile) shrink(size int64) error {
+	kept := []*ChunkItem{}
+	for idx := range cf.Chunks {
+		ci := cf.Chunks[idx]
+		if ci.Start >= size {
+			cf.dropChunk(ci)
+			continue
+		}
+		if ci.End > size {
+			if err := ci.trim(cf, size-ci.Start); err != nil {
+				return err
+			}
+			if ci.IsHole() {
+				cf.markChanged(ci)
 			}
 		}
-		cf.isDownloading = false
-	}()
+		kept = append(kept, ci)
+	}
 
-	wg.Wait()
+	cf.Chunks = kept
+	cf.NumChunks = len(kept)
+	cf.OriginalSize = int(size)
+	cf.metadataChanged = true
+	return nil
 }
 
-func (cf *ChunkFile) GetBytes(start, end int64) []byte {
-	if cf.tmpFile == nil {
-		filepath := path.Join(configs.TMP_FILE_FOLDER, cf.Id)
-		file, err := os.Create(filepath)
+// grow extends the file up to size, filling the gap with holes. The last chunk
+// is extended only if it's a hole itself, to avoid uploading its zeros
+func (cf *ChunkFile) grow(size int64) {
+	end := int64(cf.OriginalSize)
+	if len(cf.Chunks) > 0 {
+		last := cf.Chunks[len(cf.Chunks)-1]
+		if last.IsHole() && !last.isFull() {
+			last.Size = min(last.capacity(), int(size-last.Start))
+			last.End = last.Start + int64(last.Size)
+			end = last.End
+			cf.markChanged(last)
+		}
+	}
+
+	for end < size {
+		ci := NewChunkItem(
+			WithIdx(len(cf.Chunks)),
+			WithChunkFileId(cf.Id),
+			WithStart(end),
+		)
+		ci.Name = uuid.NewString()
+		ci.Size = int(min(int64(configs.CHUNK_SIZE), size-end))
+		ci.End = end + int64(ci.Size)
+		cf.Chunks = append(cf.Chunks, ci)
+		cf.markChanged(ci)
+		end = ci.End
+	}
+
+	cf.NumChunks = len(cf.Chunks)
+	cf.OriginalSize = int(size)
+	cf.metadataChanged = true
+}
+
+// dropChunk forgets a chunk past the new end of the file, discarding its pending
+// upload and marking its message as stale
+func (cf *ChunkFile) dropChunk(ci *ChunkItem) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	ci.removeSpool()
+	ci.Dirty = false
+	cache.forget(ci)
+
+	cf.changesLock.Lock()
+	defer cf.changesLock.Unlock()
+	if ci.MessageId != 0 {
+		cf.staleMessages = append(cf.staleMessages, ci.remoteRef())
+	}
+	cf.changedChunks = slices.DeleteFunc(cf.changedChunks, func(item *ChunkItem) bool {
+		return item == ci
+	})
+}
+
+func (cf *ChunkFile) markChanged(ci *ChunkItem) {
+	cf.changesLock.Lock()
+	defer cf.changesLock.Unlock()
+	if !slices.Contains(cf.changedChunks, ci) {
+		cf.changedChunks = append(cf.changedChunks, ci)
+	}
+}
+
+func (cf *ChunkFile) writeAt(data []byte, off int64) (int, error) {
+	written := 0
+	for written < len(data) {
+		pos := off + int64(written)
+		ci := cf.chunkForWrite(pos)
+		chunk := data[written:]
+		// only the last chunk grows, the others end where the next one starts
+		if ci != cf.Chunks[len(cf.Chunks)-1] || ci.isFull() {
+			chunk = chunk[:min(int64(len(chunk)), ci.End-pos)]
+		}
+		n, err := ci.write(cf, chunk, pos-ci.Start)
 		if err != nil {
-			panic(fmt.Sprintf("Failed to open temporary file %s -> %s", filepath, err.Error()))
+			return written, err
+		}
+		written += n
+		cf.OriginalSize = max(cf.OriginalSize, int(ci.End))
+	}
+	cf.NumChunks = len(cf.Chunks)
+	return written, nil
+}
+
+// chunkForWrite returns the chunk containing the byte at pos. When pos is the
+// end of the file, the last chunk is returned if it still has room, otherwise a
+// new one is appended
+func (cf *ChunkFile) chunkForWrite(pos int64) *ChunkItem {
+	for idx := range cf.Chunks {
+		ci := cf.Chunks[idx]
+		if pos >= ci.Start && pos < ci.End {
+			return ci
+		}
+	}
+
+	if len(cf.Chunks) > 0 {
+		last := cf.Chunks[len(cf.Chunks)-1]
+		if last.End == pos && !last.isFull() {
+			return last
 		}
-		file.Truncate(int64(cf.OriginalSize))
+	}
+
+	ci := NewChunkItem(
+		WithIdx(len(cf.Chunks)),
+		WithChunkFileId(cf.Id),
+		WithStart(pos),
+	)
+	ci.End = pos
+	ci.Name = uuid.NewString()
+	ci.FileState = MEMORY
+	cf.Chunks = append(cf.Chunks, ci)
+	cf.journalStale = true
+	return ci
+}
+
+// UploadFullChunks queues the upload of the dirty chunks that are full and end
+// before off, so that sequential writers don't keep the whole file in the spool
+func (cf *ChunkFile) UploadFullChunks(off int64) {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
 
-		cf.tmpFile = &temporaryFile{
-			name:           filepath,
-			bytesAvailable: 0,
-			handle:         file,
+	cf.enqueueDirty(func(ci *ChunkItem) bool {
+		return ci.isFull() && ci.End <= off
+	})
+}
+
+// enqueueDirty queues the upload of the dirty chunks accepted by filter. Must be
+// called holding writeLock
+func (cf *ChunkFile) enqueueDirty(filter func(*ChunkItem) bool) {
+	for idx := range cf.Chunks {
+		ci := cf.Chunks[idx]
+		if ci.queued.Load() || !ci.isDirty() || !filter(ci) {
+			continue
 		}
+		cf.enqueueUpload(ci)
+	}
+}
+
+// HasChanges tells whether some chunk has been modified and not saved yet
+func (cf *ChunkFile) HasChanges() bool {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	cf.changesLock.Lock()
+	changed := len(cf.changedChunks) > 0
+	cf.changesLock.Unlock()
+	if cf.metadataChanged || changed {
+		return true
+	}
+	for idx := range cf.Chunks {
+		if cf.Chunks[idx].isDirty() {
+			return true
+		}
+	}
+	return false
+}
+
+// Save uploads every dirty chunk and stores the changed ones through save. Only
+// the uploads of this file are waited for. Once saved, the messages of the
+// replaced chunks are deleted from the chat
+func (cf *ChunkFile) Save(save func(changed []*ChunkItem) error) error {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	// uploads started before the lock are discarded if their chunk was written
+	// in the meantime, so they are waited for before sending what is dirty
+	cf.uploads.Wait()
+	cf.enqueueDirty(func(*ChunkItem) bool { return true })
+	cf.uploads.Wait()
+
+	cf.changesLock.Lock()
+	defer cf.changesLock.Unlock()
+
+	if err := cf.uploadErr; err != nil {
+		cf.uploadErr = nil
+		return err
+	}
+	cf.ManifestHash = cf.manifestHash()
+	if err := save(cf.changedChunks); err != nil {
+		return err
+	}
+	cf.changedChunks = nil
+	cf.metadataChanged = false
+	cf.clearJournal()
+
+	stale := cf.staleMessages
+	cf.staleMessages = nil
+	if len(stale) > 0 {
+		go releaseStale(stale)
+	}
+	return nil
+}
+
+// ensureTmpFile creates the cache file where the downloaded chunks are kept
+func (cf *ChunkFile) ensureTmpFile() error {
+	cf.tmpFileLock.Lock()
+	defer cf.tmpFileLock.Unlock()
+
+	if cf.tmpFile != nil {
+		return nil
+	}
+	filepath := cachePath(cf.Id)
+	// a bitmap left without its file describes nothing
+	os.Remove(bitmapPath(cf.Id))
+	file, err := os.Create(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open temporary file %s: %s", filepath, err.Error())
+	}
+	file.Truncate(int64(cf.OriginalSize))
+
+	cf.tmpFile = &temporaryFile{
+		name:   filepath,
+		handle: file,
+	}
+	return nil
+}
+
+// manifestHash returns the SHA-256 of the size and the checksum of each chunk,
+// so that the content is not needed. It's not the hash of the content of the
+// file: chunk checksums cover the uploaded documents, which are compressed or
+// encrypted, and the same content cut in different chunks gets another hash.
+// Holes contribute their size only. It's empty while a chunk uploaded before
+// checksums is left. It's checked when the file is loaded, see VerifyManifest
+func (cf *ChunkFile) manifestHash() string {
+	hash := sha256.New()
+	for _, ci := range cf.Chunks {
+		if !ci.IsHole() && ci.Sha256 == "" {
+			return ""
+		}
+		fmt.Fprintf(hash, "%d %s\n", ci.Size, ci.Sha256)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// VerifyManifest checks that the chunks loaded with the file are the ones it was
+// saved with, which is not the case when a save was interrupted between the
+// chunks and the file or when the stored checksums were changed
+func (cf *ChunkFile) VerifyManifest() error {
+	if cf.ManifestHash == "" {
+		return nil
+	}
+	if hash := cf.manifestHash(); hash != cf.ManifestHash {
+		return fmt.Errorf("chunks of %s don't match its manifest hash", cf.Id)
+	}
+	return nil
+}
+
+func (cf *ChunkFile) GetBytes(start, end int64) ([]byte, error) {
+	if err := cf.ensureTmpFile(); err != nil {
+		return nil, err
 	}
 
 	var result []byte
@@ -268,12 +786,21 @@ func (cf *ChunkFile) GetBytes(start, end int64) []byte {
 		}
 
 		logger.LogInfo(fmt.Sprintf("Copying bytes from chunk %d [%d:%d]", idx, relativeStart, relativeEnd))
-		readBuf := chunk.GetBytes(relativeStart, relativeEnd, cf)
+		readBuf, err := chunk.GetBytes(relativeStart, relativeEnd, cf)
+		if errors.Is(err, errNotDownloaded) {
+			// the chunk was evicted after being fetched
+			if err = cf.FetchRange(chunk.Start, chunk.End, 0); err == nil {
+				readBuf, err = chunk.GetBytes(relativeStart, relativeEnd, cf)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
 		result = append(result, readBuf...)
 		logger.LogInfo(fmt.Sprintf("Unlocked chunk [%d]", chunk.Idx))
 	}
 
-	return result
+	return result, nil
 }
 
 // WriteFile writes all the chunk files to a file
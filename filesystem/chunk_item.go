@@ -2,9 +2,17 @@ package filesystem
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"sync"
+	"sync/atomic"
 
+	"it.smaso/tgfuse/configs"
 	"it.smaso/tgfuse/logger"
 	"it.smaso/tgfuse/telegram"
 )
@@ -16,19 +24,36 @@ const (
 	UPLOADED Status = "uploaded"
 	MEMORY   Status = "memory"
 	FILE     Status = "file"
+	SPOOL    Status = "spool" // dirty content waiting to be uploaded, see spoolContent
 )
 
+// errNotDownloaded is returned when reading a chunk that is not held locally
+var errNotDownloaded = errors.New("not downloaded yet")
+
 // ChunkItem is the single chunk that has been uploaded
 type ChunkItem struct {
-	Idx           int
-	Size          int
-	Name          string
-	Buf           *bytes.Buffer
-	FileId        *string
-	FileState     Status
-	ChunkFileId   string
-	lock          sync.RWMutex
-	isDownloading bool
+	Idx            int
+	Size           int
+	Name           string
+	Buf            *bytes.Buffer
+	bufSize        int64 // bytes of Buf accounted to the memory budget
+	FileId         *string
+	MessageId      int
+	Sha256         string // hex digest of the uploaded content, empty for holes and older chunks
+	Codec          Codec  // compression of the uploaded content, see compress
+	CompressedSize int    // bytes of the uploaded content once compressed, 0 when sent as it is
+	ContentHash    string // hex digest of the plain content when the document is shared, see DedupIndex
+	FileState      Status
+	Dirty          bool // the content changed since it was last uploaded
+	ChunkFileId    string
+	spool          *os.File
+	queued         atomic.Bool // waiting for the uploader, see enqueueUpload
+	lock           sync.RWMutex
+	isDownloading  atomic.Bool // the chunk is locked by its download, see FetchRange
+	wanted         atomic.Bool // a reader waits for the download, which is urgent
+	downloadErr    error       // reason of the last failed download, returned to readers
+	cut            bool        // the end of the chunk was found by content, see cdcLimit
+	version        uint64      // increased on every change of the content, see snapshot
 
 	Start int64
 	End   int64
@@ -36,8 +61,7 @@ type ChunkItem struct {
 
 func NewChunkItem(opts ...ChunkItemOpts) *ChunkItem {
 	inst := &ChunkItem{
-		isDownloading: false,
-		FileState:     UPLOADED,
+		FileState: UPLOADED,
 	}
 	for _, opt := range opts {
 		opt(inst)
@@ -61,8 +85,28 @@ func WithStart(start int64) func(*ChunkItem) {
 	}
 }
 
-func (ci *ChunkItem) GetBuffer() *bytes.Buffer {
-	return bytes.NewBuffer(ci.Buf.Bytes())
+// GetReader returns the content of the chunk to be sent. Spooled chunks are
+// read from disk, so that they are never loaded in memory as a whole
+func (ci *ChunkItem) GetReader() io.Reader {
+	if ci.spool != nil {
+		return io.NewSectionReader(ci.spool, 0, int64(ci.Size))
+	}
+	if ci.Buf == nil {
+		return bytes.NewReader(nil)
+	}
+	return bytes.NewReader(ci.Buf.Bytes())
+}
+
+// dropBuf frees the buffer of the chunk, giving its bytes back to the memory
+// budget
+func (ci *ChunkItem) dropBuf() {
+	ci.Buf = nil
+	memory.release(ci.bufSize)
+	ci.bufSize = 0
+}
+
+func (ci *ChunkItem) GetSize() int {
+	return ci.Size
 }
 
 func (ci *ChunkItem) GetName() string {
@@ -73,57 +117,308 @@ func (ci *ChunkItem) CanBeSent() bool {
 	return ci.FileState == MEMORY && ci.Buf.Len() > 0
 }
 
-func (ci *ChunkItem) Send() error {
-	fileID, err := telegram.SendFile(ci)
+// uploaded points the chunk to the document now holding its content. hash is
+// set when the document is shared through the DedupIndex
+func (ci *ChunkItem) uploaded(doc *DedupEntry, hash string) {
+	ci.FileId = &doc.FileId
+	ci.MessageId = doc.MessageId
+	ci.Sha256 = doc.Sha256
+	ci.Codec = doc.Codec
+	ci.CompressedSize = doc.CompressedSize
+	ci.ContentHash = hash
+	ci.dropBuf()
+	ci.FileState = UPLOADED
+	ci.Dirty = false
+}
+
+// IsHole tells whether the chunk has never been written, so that its content
+// is made only of zeros and there's nothing to download
+func (ci *ChunkItem) IsHole() bool {
+	return ci.FileId == nil && !ci.Dirty
+}
+
+func (ci *ChunkItem) isDirty() bool {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.Dirty
+}
+
+// capacity returns the maximum number of bytes the chunk can hold
+func (ci *ChunkItem) capacity() int {
+	return max(configs.CHUNK_SIZE, ci.Size)
+}
+
+// isFull tells whether no more bytes can be appended to the chunk
+func (ci *ChunkItem) isFull() bool {
+	return ci.cut || ci.Size >= ci.capacity()
+}
+
+// spoolContent moves the current content of the chunk to its spool file, where
+// it's modified until the next upload. Downloads are streamed to the file too
+func (ci *ChunkItem) spoolContent(cf *ChunkFile) error {
+	if ci.spool != nil {
+		return nil
+	}
+
+	// the chunk can't be evicted while it's being changed
+	cache.forget(ci)
+
+	filepath := spoolPath(ci.ChunkFileId, ci.Idx)
+	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
-		logger.LogErr(fmt.Sprintf("Chunk [%d] has not been sent", ci.Idx))
 		return err
 	}
-	ci.FileId = fileID
-	ci.Buf = nil
+
+	switch ci.FileState {
+	case MEMORY:
+		if ci.Buf != nil {
+			_, err = file.Write(ci.Buf.Bytes())
+		}
+	case FILE:
+		_, err = io.Copy(file, io.NewSectionReader(cf.tmpFile.getFile(), ci.Start, int64(ci.Size)))
+	case UPLOADED:
+		switch {
+		case ci.IsHole():
+			err = file.Truncate(int64(ci.Size))
+		case cf.IsEncrypted() || ci.Codec != RAW:
+			// the content can be opened only as a whole
+			size := int64(ci.Size)
+			if err = memory.reserve(context.Background(), size); err == nil {
+				var plain []byte
+				if plain, err = ci.download(cf, true); err == nil {
+					_, err = file.Write(plain)
+				}
+				memory.release(size)
+			}
+		default:
+			err = telegram.GetInstance().DownloadTo(*ci.FileId, ci.Sha256, file)
+		}
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(filepath)
+		return err
+	}
+
+	ci.spool = file
+	ci.dropBuf()
+	ci.FileState = SPOOL
+	cf.journalStale = true
+	return nil
+}
+
+// releaseSpool drops the spool file of an uploaded chunk, keeping its content in
+// the temporary file of the ChunkFile if there's one
+func (ci *ChunkItem) releaseSpool(cf *ChunkFile) {
+	if ci.spool == nil {
+		return
+	}
+
 	ci.FileState = UPLOADED
+	if cf.tmpFile != nil {
+		dst := io.NewOffsetWriter(cf.tmpFile.getFile(), ci.Start)
+		hash := sha256.New()
+		src := io.TeeReader(io.NewSectionReader(ci.spool, 0, int64(ci.Size)), hash)
+		if _, err := io.Copy(dst, src); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to copy chunk [%d] to tmp file: %s", ci.Idx, err.Error()))
+		} else {
+			cf.tmpFile.markPresent(ci, hex.EncodeToString(hash.Sum(nil)))
+			ci.FileState = FILE
+			cache.touch(cf, ci)
+		}
+	}
+	ci.removeSpool()
+}
+
+// removeSpool deletes the spool file, discarding the changes not uploaded yet
+func (ci *ChunkItem) removeSpool() {
+	if ci.spool == nil {
+		return
+	}
+	ci.spool.Close()
+	if err := os.Remove(ci.spool.Name()); err != nil {
+		logger.LogWarn(fmt.Sprintf("Failed to delete spool file of chunk [%d]: %s", ci.Idx, err.Error()))
+	}
+	ci.spool = nil
+}
+
+// trim drops the bytes of the chunk from the relative offset size onwards
+func (ci *ChunkItem) trim(cf *ChunkFile, size int64) error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	if !ci.IsHole() {
+		if err := ci.spoolContent(cf); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to load chunk [%d] for truncating: %s", ci.Idx, err.Error()))
+			return err
+		}
+		if err := ci.spool.Truncate(size); err != nil {
+			return err
+		}
+		ci.Dirty = true
+	}
+	ci.Size = int(size)
+	ci.End = ci.Start + size
+	ci.cut = false
+	ci.version++
 	return nil
 }
 
+// cdcLimit returns how many bytes of data, written at the relative offset rel
+// and growing the chunk, fit before the end found by content. Must be called
+// on a spooled chunk
+func (ci *ChunkItem) cdcLimit(data []byte, rel int64) (int, error) {
+	overlap := ci.Size - int(rel)
+	// the hash continues from the bytes right before the ones appended
+	tail := make([]byte, rel-max(0, rel-gearWindow))
+	if _, err := ci.spool.ReadAt(tail, rel-int64(len(tail))); err != nil && err != io.EOF {
+		return 0, err
+	}
+	tail = append(tail, data[:overlap]...)
+
+	n, cut := cdcCut(tail, ci.Size, data[overlap:])
+	ci.cut = cut
+	return overlap + n, nil
+}
+
+// write copies data in the chunk starting from the relative offset rel, spooling
+// its current content first. Returns the number of bytes that fit in the chunk
+func (ci *ChunkItem) write(cf *ChunkFile, data []byte, rel int64) (int, error) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	if err := ci.spoolContent(cf); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to load chunk [%d] for writing: %s", ci.Idx, err.Error()))
+		return 0, err
+	}
+
+	n := min(len(data), ci.capacity()-int(rel))
+	if cf.ChunkingStrategy() == CDC && int(rel)+n > ci.Size {
+		var err error
+		if n, err = ci.cdcLimit(data[:n], rel); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := ci.spool.WriteAt(data[:n], rel); err != nil {
+		return 0, err
+	}
+
+	ci.Size = max(ci.Size, int(rel)+n)
+	ci.End = ci.Start + int64(ci.Size)
+	ci.Dirty = true
+	ci.version++
+	return n, nil
+}
+
+// DeleteRemote deletes the message containing the chunk from the chat, once no
+// other chunk shares it. Chunks uploaded before message ids were stored can't
+// be deleted and are skipped
+func (ci *ChunkItem) DeleteRemote() error {
+	if ci.MessageId == 0 {
+		logger.LogWarn(fmt.Sprintf("Chunk [%d] of %s has no message id, skipping remote deletion", ci.Idx, ci.ChunkFileId))
+		return nil
+	}
+	return releaseRemote(ci.remoteRef())
+}
+
 // shouldBeDownloaded check wether the chunk must be downloaded or if it's already downloaded
 func (ci *ChunkItem) shouldBeDownloaded() bool {
-	if ci.isDownloading {
+	if ci.isDownloading.Load() || ci.Dirty || ci.FileId == nil {
 		return false
 	}
 	return ci.FileState != FILE && ci.FileState != MEMORY
 }
 
 func (ci *ChunkItem) fetchBuffer(cf *ChunkFile) error {
-	ci.isDownloading = true
-	defer func() {
-		ci.isDownloading = false
-	}()
+	ci.isDownloading.Store(true)
+	defer ci.isDownloading.Store(false)
 
-	bts, err := telegram.GetInstance().DownloadFile(*ci.FileId)
+	size := int64(ci.Size)
+	err := memory.reserve(context.Background(), size)
+	var bts []byte
+	if err == nil {
+		if bts, err = ci.download(cf, false); err != nil {
+			memory.release(size)
+		}
+	}
+	ci.downloadErr = err
 	if err != nil {
 		logger.LogErr(fmt.Sprintf("failed to download chunk [%d]: %s", ci.Idx, err.Error()))
 		return err
 	}
 
 	logger.LogInfo(fmt.Sprintf("downloaded chunk [%d] from telegram", ci.Idx))
-	ci.Buf = bytes.NewBuffer(*bts)
+	ci.Buf = bytes.NewBuffer(bts)
+	ci.bufSize = size
 	ci.FileState = MEMORY
 
 	// moves the bytes out of ram
 	if cf.tmpFile != nil {
 		handle := cf.tmpFile.getFile()
-		if _, err := handle.WriteAt(*bts, ci.Start); err != nil {
+		if _, err := handle.WriteAt(bts, ci.Start); err != nil {
 			logger.LogErr(fmt.Sprintf("Failed to write chunk [%d] to tmp file: %s", ci.Idx, err.Error()))
 		} else {
+			cf.tmpFile.markPresent(ci, contentSum(bts))
 			ci.FileState = FILE
-			ci.Buf = nil
+			ci.dropBuf()
 		}
 	}
+	cache.touch(cf, ci)
 
 	return nil
 }
 
-func (ci *ChunkItem) GetBytes(start, end int64, cf *ChunkFile) []byte {
+// download returns the plain content of the chunk, decrypted if the file is
+// encrypted and decompressed if it was uploaded compressed. Non urgent
+// downloads wait for reads to be served first. The memory of the plain content
+// is reserved by the caller, the one of the copies made on the way is reserved
+// here
+func (ci *ChunkItem) download(cf *ChunkFile, urgent bool) ([]byte, error) {
+	key, err := cf.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	overhead := ci.downloadOverhead(cf)
+	if err := memory.reserve(context.Background(), overhead); err != nil {
+		return nil, err
+	}
+	defer memory.release(overhead)
+
+	bts, err := telegram.GetInstance().DownloadFile(*ci.FileId, ci.Sha256, func() bool {
+		return urgent || ci.wanted.Load()
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := openContent(key, *bts, chunkAAD(ci.ChunkFileId, ci.Idx))
+	if err == nil {
+		data, err = decompress(ci.Codec, data, ci.Size)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("chunk [%d]: %w", ci.Idx, err)
+	}
+	return data, nil
+}
+
+// downloadOverhead returns the bytes held by a download besides the plain
+// content: the downloaded payload when it must be decrypted or decompressed, and
+// the decrypted payload when it must be decompressed too
+func (ci *ChunkItem) downloadOverhead(cf *ChunkFile) int64 {
+	payload := int64(ci.Size)
+	if ci.Codec != RAW {
+		payload = int64(ci.CompressedSize)
+	}
+	var overhead int64
+	if cf.IsEncrypted() {
+		overhead += payload
+	}
+	if ci.Codec != RAW {
+		overhead += payload
+	}
+	return overhead
+}
+
+func (ci *ChunkItem) GetBytes(start, end int64, cf *ChunkFile) ([]byte, error) {
 	logger.LogInfo(fmt.Sprintf("Chunk [%d] locked on read lock", ci.Idx))
 	ci.lock.RLocker().Lock()
 	defer ci.lock.RLocker().Unlock()
@@ -133,31 +428,47 @@ func (ci *ChunkItem) GetBytes(start, end int64, cf *ChunkFile) []byte {
 
 	switch ci.FileState {
 	case MEMORY:
-		return ci.Buf.Bytes()[start:end]
+		cache.touch(cf, ci)
+		return ci.Buf.Bytes()[start:end], nil
+	case SPOOL:
+		buf := make([]byte, end-start)
+		if _, err := ci.spool.ReadAt(buf, start); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read bytes for chunk [%d] from spool file: %s", ci.Idx, err.Error())
+		}
+		return buf, nil
 	case FILE:
+		cache.touch(cf, ci)
 		file := cf.tmpFile.getFile()
 		buf := make([]byte, end-start)
-		_, err := file.ReadAt(buf, ci.Start+start)
-		if err != nil {
-			logger.LogErr(fmt.Sprintf("Failed to read bytes for chunk [%d] from tmp file: %s", ci.Idx, err.Error()))
+		if _, err := file.ReadAt(buf, ci.Start+start); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read bytes for chunk [%d] from tmp file: %s", ci.Idx, err.Error())
 		}
-		return buf
+		return buf, nil
 	case UPLOADED:
-		logger.LogErr(fmt.Sprintf("Chunk [%d] has not been downloaded yet", ci.Idx))
-		return []byte{}
+		if ci.IsHole() {
+			return make([]byte, end-start), nil
+		}
 	}
 
-	return []byte{}
+	// the download failed, the error has the reason
+	if ci.downloadErr != nil {
+		return nil, ci.downloadErr
+	}
+	return nil, fmt.Errorf("chunk [%d]: %w", ci.Idx, errNotDownloaded)
 }
 
 func (ci *ChunkItem) PruneFromRam() {
+	if ci.Dirty {
+		return
+	}
+	cache.forget(ci)
 	switch ci.FileState {
 	case MEMORY:
-		ci.Buf = nil
+		ci.dropBuf()
 		ci.FileState = UPLOADED
 		ci.Buf = &bytes.Buffer{}
 	case FILE:
-		ci.Buf = nil
+		ci.dropBuf()
 		ci.FileState = UPLOADED
 	}
 }
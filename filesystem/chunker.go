@@ -0,0 +1,107 @@
+package filesystem
+
+import (
+	"math/bits"
+
+	"it.smaso/tgfuse/configs"
+)
+
+type Chunking = string
+
+// Strategies cutting the content of a file in chunks. FIXED cuts every
+// CHUNK_SIZE bytes, CDC cuts where the content matches a rolling hash, so that
+// inserting bytes in a file rewritten as a whole changes only the chunks around
+// the insertion and the others are deduplicated
+const (
+	FIXED Chunking = "fixed"
+	CDC   Chunking = "cdc"
+)
+
+// IsValidChunking tells whether files can be cut with strategy
+func IsValidChunking(strategy Chunking) bool {
+	return strategy == FIXED || strategy == CDC
+}
+
+// gearWindow is the number of trailing bytes the gear hash depends on, since
+// older bytes are shifted out
+const gearWindow = 64
+
+// gear maps every byte to a random value. It must be the same on every mount
+// for the same content to be cut at the same points, so it's generated from a
+// fixed seed
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x7467667573652d63) // splitmix64
+	for idx := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[idx] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cdcBounds returns the minimum, average and maximum size of the chunks cut by
+// content. Chunks never exceed CHUNK_SIZE, which is below the upload limit
+func cdcBounds() (int, int, int) {
+	maxSize := configs.CHUNK_SIZE
+	avgSize := min(configs.CDC_AVG_CHUNK_SIZE, maxSize)
+	return avgSize / 4, avgSize, maxSize
+}
+
+// cdcMasks returns the masks the hash is matched with before and after the
+// average size is reached, following FastCDC normalized chunking: cuts are
+// harder to find in small chunks and easier in large ones, so that sizes stay
+// close to the average. The masks take the highest bits, which depend on the
+// whole window
+func cdcMasks(avgSize int) (uint64, uint64) {
+	avgBits := bits.Len(uint(avgSize)) - 1
+	return ^uint64(0) << (64 - (avgBits + 2)), ^uint64(0) << (64 - (avgBits - 2))
+}
+
+// gearHash returns the hash after the given bytes, which must be the trailing
+// ones of what was hashed
+func gearHash(tail []byte) uint64 {
+	var hash uint64
+	for _, b := range tail[max(0, len(tail)-gearWindow):] {
+		hash = (hash << 1) + gear[b]
+	}
+	return hash
+}
+
+// cdcCut looks for the end of a chunk holding size bytes, whose trailing bytes
+// are tail, once data is appended to it. Returns how many bytes of data belong
+// to the chunk and whether the chunk ends there
+func cdcCut(tail []byte, size int, data []byte) (int, bool) {
+	minSize, avgSize, maxSize := cdcBounds()
+	maskSmall, maskLarge := cdcMasks(avgSize)
+
+	hash := gearHash(tail)
+	for idx, b := range data {
+		hash = (hash << 1) + gear[b]
+		length := size + idx + 1
+		switch {
+		case length >= maxSize:
+			return idx + 1, true
+		case length < minSize:
+			continue
+		case length < avgSize && hash&maskSmall == 0:
+			return idx + 1, true
+		case length >= avgSize && hash&maskLarge == 0:
+			return idx + 1, true
+		}
+	}
+	return len(data), false
+}
+
+// cdcSplit cuts content in chunks by content, returning their sizes
+func cdcSplit(content []byte) []int {
+	sizes := []int{}
+	for len(content) > 0 {
+		n, _ := cdcCut(nil, 0, content)
+		sizes = append(sizes, n)
+		content = content[n:]
+	}
+	return sizes
+}
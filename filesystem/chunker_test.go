@@ -0,0 +1,166 @@
+package filesystem
+
+import (
+	"bytes"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"it.smaso/tgfuse/configs"
+)
+
+// smallChunks cuts chunks of 1KiB on average and 4KiB at most for the test
+func smallChunks(t *testing.T) {
+	chunkSize, avgSize := configs.CHUNK_SIZE, configs.CDC_AVG_CHUNK_SIZE
+	configs.CHUNK_SIZE, configs.CDC_AVG_CHUNK_SIZE = 4<<10, 1<<10
+	t.Cleanup(func() {
+		configs.CHUNK_SIZE, configs.CDC_AVG_CHUNK_SIZE = chunkSize, avgSize
+	})
+}
+
+func randomContent(size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	return content
+}
+
+// cutOffsets returns the offsets the chunks of the given sizes end at
+func cutOffsets(sizes []int) []int {
+	offsets := []int{}
+	var offset int
+	for _, size := range sizes {
+		offset += size
+		offsets = append(offsets, offset)
+	}
+	return offsets
+}
+
+func TestCdcSplit(t *testing.T) {
+	smallChunks(t)
+	minSize, _, maxSize := cdcBounds()
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    []int // nil when only the bounds of the sizes are checked
+	}{
+		{name: "empty", content: []byte{}, want: []int{}},
+		{name: "shorter than the minimum", content: randomContent(minSize - 1), want: []int{minSize - 1}},
+		{name: "random", content: randomContent(256 << 10)},
+		{name: "constant", content: bytes.Repeat([]byte{0}, 64<<10)},
+		{name: "repeated pattern", content: bytes.Repeat([]byte("tgfuse"), 16<<10)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes := cdcSplit(tt.content)
+			if tt.want != nil && !slices.Equal(sizes, tt.want) {
+				t.Fatalf("cdcSplit() = %v, want %v", sizes, tt.want)
+			}
+
+			var total int
+			for idx, size := range sizes {
+				total += size
+				if size > maxSize {
+					t.Errorf("chunk %d has %d bytes, more than %d", idx, size, maxSize)
+				}
+				if size < minSize && idx < len(sizes)-1 {
+					t.Errorf("chunk %d has %d bytes, less than %d", idx, size, minSize)
+				}
+			}
+			if total != len(tt.content) {
+				t.Errorf("chunks hold %d bytes, want %d", total, len(tt.content))
+			}
+		})
+	}
+}
+
+func TestCdcSplitInsertion(t *testing.T) {
+	smallChunks(t)
+	content := randomContent(256 << 10)
+	inserted := slices.Concat(content[:1000], []byte("inserted bytes"), content[1000:])
+
+	// cuts after the insertion are found at the same content
+	shift := len(inserted) - len(content)
+	before := cutOffsets(cdcSplit(content))
+	after := cutOffsets(cdcSplit(inserted))
+	var shared int
+	for _, offset := range after {
+		if offset > 1000+shift && slices.Contains(before, offset-shift) {
+			shared++
+		}
+	}
+	if shared < len(before)/2 {
+		t.Errorf("%d cuts out of %d survived the insertion", shared, len(before))
+	}
+}
+
+func TestCdcCut(t *testing.T) {
+	smallChunks(t)
+	minSize, _, maxSize := cdcBounds()
+
+	tests := []struct {
+		name      string
+		size      int
+		data      []byte
+		wantN     int
+		wantFound bool
+	}{
+		{name: "no data", size: 0, data: []byte{}, wantN: 0, wantFound: false},
+		{name: "below the minimum", size: 0, data: randomContent(minSize - 1), wantN: minSize - 1, wantFound: false},
+		{name: "reaching the maximum", size: maxSize - 1, data: randomContent(10), wantN: 1, wantFound: true},
+		{name: "past the maximum", size: maxSize - 10, data: bytes.Repeat([]byte{0}, 100), wantN: 10, wantFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, found := cdcCut(nil, tt.size, tt.data)
+			if n != tt.wantN || found != tt.wantFound {
+				t.Errorf("cdcCut() = (%d, %v), want (%d, %v)", n, found, tt.wantN, tt.wantFound)
+			}
+		})
+	}
+}
+
+// TestCdcCutStreaming checks that content written in pieces is cut as the
+// content written at once
+func TestCdcCutStreaming(t *testing.T) {
+	smallChunks(t)
+	content := randomContent(128 << 10)
+	want := cdcSplit(content)
+
+	tests := []struct {
+		name  string
+		piece int
+	}{
+		{name: "single bytes", piece: 1},
+		{name: "odd pieces", piece: 7},
+		{name: "pieces smaller than the window", piece: gearWindow / 2},
+		{name: "pieces larger than a chunk", piece: 5000},
+		{name: "whole content", piece: len(content)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes := []int{}
+			var chunk []byte
+			for piece := range slices.Chunk(content, tt.piece) {
+				for len(piece) > 0 {
+					n, found := cdcCut(chunk, len(chunk), piece)
+					chunk = append(chunk, piece[:n]...)
+					piece = piece[n:]
+					if found {
+						sizes = append(sizes, len(chunk))
+						chunk = nil
+					}
+				}
+			}
+			if len(chunk) > 0 {
+				sizes = append(sizes, len(chunk))
+			}
+			if !slices.Equal(sizes, want) {
+				t.Errorf("cut in pieces of %d bytes = %v, want %v", tt.piece, sizes, want)
+			}
+		})
+	}
+}
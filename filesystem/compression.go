@@ -0,0 +1,169 @@
+package filesystem
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/logger"
+)
+
+type Codec = string
+
+// Codecs the chunks can be uploaded with. The codec of each chunk is stored with
+// it, so that chunks are read back whatever COMPRESSION is set to
+const (
+	RAW  Codec = ""
+	GZIP Codec = "gzip"
+	ZSTD Codec = "zstd"
+)
+
+type compressor struct {
+	compress   func(plain []byte) ([]byte, error)
+	decompress func(data []byte, size int) ([]byte, error)
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCoders returns the zstd encoder and decoder, which are safe to be shared
+// when used on whole buffers. The decoder never allocates more than a chunk,
+// whatever the downloaded content claims
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		limit := uint64(configs.CHUNK_SIZE)
+		zstdDecoder, zstdErr = zstd.NewReader(nil,
+			zstd.WithDecoderMaxMemory(limit),
+			zstd.WithDecoderMaxWindow(min(max(limit, zstd.MinWindowSize), zstd.MaxWindowSize)),
+		)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+var compressors = map[Codec]compressor{
+	GZIP: {
+		compress: func(plain []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			writer := gzip.NewWriter(&buf)
+			if _, err := writer.Write(plain); err != nil {
+				return nil, err
+			}
+			if err := writer.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decompress: func(data []byte, size int) ([]byte, error) {
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			// a byte past size is enough to tell the content is too large
+			plain := bytes.NewBuffer(make([]byte, 0, size))
+			_, err = io.Copy(plain, io.LimitReader(reader, int64(size)+1))
+			return plain.Bytes(), err
+		},
+	},
+	ZSTD: {
+		compress: func(plain []byte) ([]byte, error) {
+			encoder, _, err := zstdCoders()
+			if err != nil {
+				return nil, err
+			}
+			return encoder.EncodeAll(plain, nil), nil
+		},
+		decompress: func(data []byte, size int) ([]byte, error) {
+			_, decoder, err := zstdCoders()
+			if err != nil {
+				return nil, err
+			}
+			return decoder.DecodeAll(data, make([]byte, 0, size))
+		},
+	},
+}
+
+// IsValidCodec tells whether chunks can be compressed with codec
+func IsValidCodec(codec Codec) bool {
+	_, ok := compressors[codec]
+	return ok || codec == RAW
+}
+
+// payload is the content of a chunk as it's uploaded
+type payload struct {
+	codec Codec
+	data  []byte // compressed content, nil when the chunk is sent as it is
+}
+
+// compress returns the content of the chunk compressed with COMPRESSION. The
+// chunk is sent as it is when compression is disabled or when its content
+// doesn't shrink by COMPRESSION_MIN_SAVING percent at least. The compressed
+// content is held in memory until release is called
+func (u *chunkUpload) compress() (*payload, error) {
+	codec, ok := compressors[configs.COMPRESSION]
+	if !ok {
+		return &payload{codec: RAW}, nil
+	}
+
+	// both the plain content and the compressed one are held while compressing
+	size := int64(u.size)
+	if err := memory.reserve(context.Background(), 2*size); err != nil {
+		return nil, err
+	}
+	plain, err := io.ReadAll(u.GetReader())
+	if err != nil {
+		memory.release(2 * size)
+		return nil, err
+	}
+	data, err := codec.compress(plain)
+	memory.release(size)
+	if err != nil {
+		memory.release(size)
+		return nil, err
+	}
+
+	if len(data) > u.size*(100-configs.COMPRESSION_MIN_SAVING)/100 {
+		logger.LogInfo(fmt.Sprintf("Chunk [%d] is not compressible, sending it as it is", u.idx))
+		memory.release(size)
+		return &payload{codec: RAW}, nil
+	}
+	return &payload{codec: configs.COMPRESSION, data: data}, nil
+}
+
+// release gives the memory of the compressed content back
+func (p *payload) release(size int) {
+	if p.data != nil {
+		memory.release(int64(size))
+		p.data = nil
+	}
+}
+
+// decompress returns the plain content of a chunk uploaded with codec
+func decompress(codec Codec, data []byte, size int) ([]byte, error) {
+	if codec == RAW {
+		return data, nil
+	}
+	compressor, ok := compressors[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+	plain, err := compressor.decompress(data, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s content: %s", codec, err.Error())
+	}
+	if len(plain) != size {
+		return nil, fmt.Errorf("decompressed %d bytes out of %d", len(plain), size)
+	}
+	return plain, nil
+}
@@ -0,0 +1,76 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	random := make([]byte, 64<<10)
+	rand.Read(random)
+
+	tests := []struct {
+		name  string
+		plain []byte
+	}{
+		{name: "empty", plain: []byte{}},
+		{name: "single byte", plain: []byte{42}},
+		{name: "repetitive", plain: bytes.Repeat([]byte("tgfuse "), 10000)},
+		{name: "random", plain: random},
+	}
+
+	for _, codec := range []Codec{GZIP, ZSTD} {
+		for _, tt := range tests {
+			t.Run(codec+" "+tt.name, func(t *testing.T) {
+				data, err := compressors[codec].compress(tt.plain)
+				if err != nil {
+					t.Fatalf("compress() error = %v", err)
+				}
+				got, err := decompress(codec, data, len(tt.plain))
+				if err != nil {
+					t.Fatalf("decompress() error = %v", err)
+				}
+				if !bytes.Equal(got, tt.plain) {
+					t.Errorf("decompress() returned %d bytes, different from the %d compressed", len(got), len(tt.plain))
+				}
+			})
+		}
+	}
+}
+
+func TestDecompressRejects(t *testing.T) {
+	plain := bytes.Repeat([]byte("tgfuse "), 10000)
+	compressed := map[Codec][]byte{}
+	for _, codec := range []Codec{GZIP, ZSTD} {
+		data, err := compressors[codec].compress(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed[codec] = data
+	}
+
+	tests := []struct {
+		name  string
+		codec Codec
+		data  []byte
+		size  int
+	}{
+		{name: "gzip larger than declared", codec: GZIP, data: compressed[GZIP], size: 100},
+		{name: "zstd larger than declared", codec: ZSTD, data: compressed[ZSTD], size: 100},
+		{name: "gzip smaller than declared", codec: GZIP, data: compressed[GZIP], size: len(plain) + 1},
+		{name: "zstd smaller than declared", codec: ZSTD, data: compressed[ZSTD], size: len(plain) + 1},
+		{name: "gzip truncated", codec: GZIP, data: compressed[GZIP][:len(compressed[GZIP])/2], size: len(plain)},
+		{name: "zstd truncated", codec: ZSTD, data: compressed[ZSTD][:len(compressed[ZSTD])/2], size: len(plain)},
+		{name: "not compressed", codec: ZSTD, data: plain, size: len(plain)},
+		{name: "unknown codec", codec: "lz4", data: compressed[ZSTD], size: len(plain)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decompress(tt.codec, tt.data, tt.size); err == nil {
+				t.Errorf("decompress() succeeded, want an error")
+			}
+		})
+	}
+}
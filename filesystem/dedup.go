@@ -0,0 +1,112 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/encryption"
+	"it.smaso/tgfuse/logger"
+	"it.smaso/tgfuse/telegram"
+)
+
+// DedupEntry is the document holding the content of a chunk, shared by every
+// chunk with the same content
+type DedupEntry struct {
+	FileId         string
+	MessageId      int
+	Sha256         string
+	Codec          Codec
+	CompressedSize int
+}
+
+// DedupIndex maps the hash of the plain content of chunks to the document
+// holding it, counting the chunks that reference each document
+type DedupIndex interface {
+	// AcquireContent adds a reference to the document holding the content with
+	// the given hash, returning nil if there's none
+	AcquireContent(hash string) (*DedupEntry, error)
+	// RegisterContent records a document just uploaded with a single reference.
+	// Returns false if another document was registered for hash first
+	RegisterContent(hash string, entry DedupEntry) (bool, error)
+	// ReleaseContent drops a reference, returning true when it was the last one
+	// and the document can be deleted
+	ReleaseContent(hash string) (bool, error)
+}
+
+var dedup DedupIndex
+
+// SetDedupIndex enables the deduplication of the uploaded chunks through index
+func SetDedupIndex(index DedupIndex) {
+	dedup = index
+}
+
+// remoteRef is the document a chunk was uploaded to
+type remoteRef struct {
+	MessageId   int
+	ContentHash string
+}
+
+func (ci *ChunkItem) remoteRef() remoteRef {
+	return remoteRef{MessageId: ci.MessageId, ContentHash: ci.ContentHash}
+}
+
+// releaseRemote drops the reference of a chunk to its document, deleting the
+// message once no chunk references it anymore. References are dropped even when
+// DELETE_REMOTE_MESSAGES is off, so that the index keeps counting right
+func releaseRemote(ref remoteRef) error {
+	if ref.ContentHash != "" && dedup != nil {
+		last, err := dedup.ReleaseContent(ref.ContentHash)
+		if err != nil || !last {
+			return err
+		}
+	}
+	if !configs.DELETE_REMOTE_MESSAGES {
+		return nil
+	}
+	return telegram.DeleteMessage(ref.MessageId)
+}
+
+// contentHash returns the hex digest of the plain content of the chunk. The
+// digest is keyed when metadata is encrypted, so that the index doesn't tell
+// whether some known content is stored
+func (u *chunkUpload) contentHash() (string, error) {
+	var hash hash.Hash = sha256.New()
+	if configs.ENCRYPT_METADATA {
+		var err error
+		if hash, err = encryption.IndexHash(); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.Copy(hash, u.GetReader()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// lookupUploaded returns the document already holding the content of the chunk,
+// adding a reference to it, nil if there's none. Failures of the index are
+// logged and the chunk is uploaded
+func (u *chunkUpload) lookupUploaded(hash string) *DedupEntry {
+	entry, err := dedup.AcquireContent(hash)
+	if err != nil {
+		logger.LogWarn(fmt.Sprintf("Failed to look up chunk [%d] in the dedup index: %s", u.idx, err.Error()))
+		return nil
+	}
+	return entry
+}
+
+// registerUploaded records the document the chunk was just uploaded to, so that
+// chunks with the same content reuse it. Returns false when the chunk keeps its
+// own document, because another upload got indexed first
+func (u *chunkUpload) registerUploaded(hash string, doc *DedupEntry) bool {
+	registered, err := dedup.RegisterContent(hash, *doc)
+	if err != nil {
+		logger.LogWarn(fmt.Sprintf("Failed to add chunk [%d] to the dedup index: %s", u.idx, err.Error()))
+		return false
+	}
+	return registered
+}
@@ -0,0 +1,28 @@
+package filesystem
+
+import "github.com/google/uuid"
+
+// ROOT_ID is the id used as parent by the entries placed in the mount point
+const ROOT_ID = ""
+
+// Directory represents a folder of the mounted tree. Files and folders refer to
+// the folder containing them through its Id
+type Directory struct {
+	Id       string
+	Name     string
+	ParentId string
+	Attributes
+}
+
+func NewDirectory(name, parentId string, attrs Attributes) *Directory {
+	return &Directory{
+		Id:         uuid.NewString(),
+		Name:       name,
+		ParentId:   parentId,
+		Attributes: attrs,
+	}
+}
+
+func (d *Directory) IsRoot() bool {
+	return d.Id == ROOT_ID
+}
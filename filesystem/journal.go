@@ -0,0 +1,355 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/logger"
+)
+
+// The journal keeps track of the files with changes not stored in the database
+// yet, so that they can be completed after a crash. Each file has a folder
+// named after its id containing:
+//   - layout.json, the metadata and the chunks of the file as of the last change
+//     of its layout
+//   - <idx>.sent, the references of every chunk uploaded since then
+//
+// The content of the chunks not uploaded yet is in their spool files.
+
+type journalChunk struct {
+	Idx            int
+	Start          int64
+	End            int64
+	Size           int
+	Name           string
+	FileId         string
+	MessageId      int
+	Sha256         string
+	Codec          Codec
+	CompressedSize int
+	ContentHash    string
+}
+
+type journalLayout struct {
+	Id         string
+	ParentId   string
+	Filename   string
+	Nlink      int
+	Attributes Attributes
+	WrappedKey string
+	Chunking   Chunking
+	Chunks     []journalChunk
+}
+
+type journalSent struct {
+	FileId         string
+	MessageId      int
+	Sha256         string
+	Codec          Codec
+	CompressedSize int
+	ContentHash    string
+}
+
+func journalPath(cfId string) string {
+	return path.Join(configs.JOURNAL_FOLDER, cfId)
+}
+
+func spoolPath(cfId string, idx int) string {
+	return path.Join(configs.SPOOL_FOLDER, fmt.Sprintf("%s-%d", cfId, idx))
+}
+
+// writeDurable replaces the file at name with data, so that a crash leaves
+// either the old or the new content
+func writeDurable(name string, data []byte) error {
+	tmp := name + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// syncJournal records the layout of the file if it changed since the last time.
+// Must be called holding writeLock
+func (cf *ChunkFile) syncJournal() {
+	if !cf.journalStale {
+		return
+	}
+
+	layout := journalLayout{
+		Id:         cf.Id,
+		ParentId:   cf.ParentId,
+		Filename:   cf.OriginalFilename,
+		Nlink:      cf.Nlink,
+		Attributes: cf.Attributes,
+		WrappedKey: cf.WrappedKey,
+		Chunking:   cf.Chunking,
+	}
+	var err error
+	for idx := range cf.Chunks {
+		ci := cf.Chunks[idx]
+		ci.lock.RLock()
+		chunk := journalChunk{
+			Idx:            ci.Idx,
+			Start:          ci.Start,
+			End:            ci.End,
+			Size:           ci.Size,
+			Name:           ci.Name,
+			MessageId:      ci.MessageId,
+			Sha256:         ci.Sha256,
+			Codec:          ci.Codec,
+			CompressedSize: ci.CompressedSize,
+			ContentHash:    ci.ContentHash,
+		}
+		if ci.FileId != nil {
+			chunk.FileId = *ci.FileId
+		}
+		// the journal must not reference content that a crash can still lose
+		if ci.spool != nil && err == nil {
+			err = ci.spool.Sync()
+		}
+		ci.lock.RUnlock()
+		layout.Chunks = append(layout.Chunks, chunk)
+	}
+
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(layout)
+	}
+	if err == nil {
+		err = os.MkdirAll(journalPath(cf.Id), 0o700)
+	}
+	if err == nil {
+		err = writeDurable(path.Join(journalPath(cf.Id), "layout.json"), data)
+	}
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to write journal of %s: %s", cf.OriginalFilename, err.Error()))
+		return
+	}
+	cf.journalStale = false
+
+	// uploads of chunks dropped by a truncate must not be matched with the
+	// chunks taking their index later
+	sent, _ := filepath.Glob(path.Join(journalPath(cf.Id), "*.sent"))
+	for _, name := range sent {
+		idx, err := strconv.Atoi(strings.TrimSuffix(path.Base(name), ".sent"))
+		if err == nil && idx >= len(cf.Chunks) {
+			os.Remove(name)
+		}
+	}
+}
+
+// Moved records the new name of the file in its journal, if it has changes that
+// are not stored yet
+func (cf *ChunkFile) Moved() {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	if _, err := os.Stat(path.Join(journalPath(cf.Id), "layout.json")); err != nil {
+		return
+	}
+	cf.journalStale = true
+	cf.syncJournal()
+}
+
+// journalSent records the references of a chunk just uploaded
+func (cf *ChunkFile) journalSent(ci *ChunkItem) {
+	data, err := json.Marshal(journalSent{
+		FileId:         *ci.FileId,
+		MessageId:      ci.MessageId,
+		Sha256:         ci.Sha256,
+		Codec:          ci.Codec,
+		CompressedSize: ci.CompressedSize,
+		ContentHash:    ci.ContentHash,
+	})
+	if err == nil {
+		err = writeDurable(path.Join(journalPath(cf.Id), fmt.Sprintf("%d.sent", ci.Idx)), data)
+	}
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to journal chunk [%d] of %s: %s", ci.Idx, cf.OriginalFilename, err.Error()))
+	}
+}
+
+// clearJournal forgets the file once every change is stored
+func (cf *ChunkFile) clearJournal() {
+	if err := os.RemoveAll(journalPath(cf.Id)); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to clear journal of %s: %s", cf.OriginalFilename, err.Error()))
+	}
+	cf.journalStale = true
+}
+
+// ReplayJournal completes the files left with pending changes by a crash. The
+// spooled chunks are uploaded and every file is passed to commit, which stores
+// it in the database. Files failing to be committed are kept for the next run.
+// A crash while uploading may leave behind chunks that are sent twice. The
+// journal is read right away and replayed in background, the returned channel
+// is closed once done
+func ReplayJournal(commit func(cf *ChunkFile) error) <-chan struct{} {
+	done := make(chan struct{})
+	if err := os.MkdirAll(configs.JOURNAL_FOLDER, 0o700); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to create journal dir: %s", err.Error()))
+		close(done)
+		return done
+	}
+	if err := os.MkdirAll(configs.SPOOL_FOLDER, 0o700); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to create spool dir: %s", err.Error()))
+		close(done)
+		return done
+	}
+
+	// files changed from now on are journaled by this mount and left alone
+	entries, err := os.ReadDir(configs.JOURNAL_FOLDER)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to read journal: %s", err.Error()))
+		close(done)
+		return done
+	}
+	spooled, err := os.ReadDir(configs.SPOOL_FOLDER)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to read spool dir: %s", err.Error()))
+		spooled = nil
+	}
+
+	go func() {
+		defer close(done)
+		replayJournal(entries, spooled, commit)
+	}()
+	return done
+}
+
+func replayJournal(entries, spooled []os.DirEntry, commit func(cf *ChunkFile) error) {
+	pending := map[string]bool{}
+	for _, entry := range entries {
+		cf, err := restoreJournal(entry.Name())
+		if errors.Is(err, fs.ErrNotExist) {
+			// the file was saved or deleted before its layout was written
+			os.RemoveAll(journalPath(entry.Name()))
+			continue
+		}
+		if err == nil {
+			logger.LogInfo(fmt.Sprintf("Resuming upload of %s from journal", cf.OriginalFilename))
+			err = cf.Save(func(changed []*ChunkItem) error {
+				return commit(cf)
+			})
+		}
+		if err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to replay journal of %s: %s", entry.Name(), err.Error()))
+			pending[entry.Name()] = true
+		}
+	}
+
+	// spool files of files not in the journal have nothing to be matched with
+	for _, entry := range spooled {
+		sep := strings.LastIndex(entry.Name(), "-")
+		// copies taken for an upload are never needed after it
+		if sep >= 0 && pending[entry.Name()[:sep]] && !strings.HasSuffix(entry.Name(), ".upload") {
+			continue
+		}
+		if err := os.Remove(path.Join(configs.SPOOL_FOLDER, entry.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.LogWarn(fmt.Sprintf("Failed to delete stale spool file %s: %s", entry.Name(), err.Error()))
+		}
+	}
+}
+
+// restoreJournal rebuilds the file from its journal. Chunks with a spool file
+// are marked dirty, since their content is newer than any upload
+func restoreJournal(cfId string) (*ChunkFile, error) {
+	data, err := os.ReadFile(path.Join(journalPath(cfId), "layout.json"))
+	if err != nil {
+		return nil, err
+	}
+	var layout journalLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return nil, err
+	}
+
+	cf := &ChunkFile{
+		Id:               layout.Id,
+		ParentId:         layout.ParentId,
+		OriginalFilename: layout.Filename,
+		Nlink:            layout.Nlink,
+		Attributes:       layout.Attributes,
+		WrappedKey:       layout.WrappedKey,
+		Chunking:         layout.Chunking,
+		metadataChanged:  true,
+	}
+
+	var start int64
+	for _, chunk := range layout.Chunks {
+		// journals written before the bounds were recorded follow the sizes
+		if chunk.End == 0 && chunk.Size > 0 {
+			chunk.Start = start
+		}
+		ci := NewChunkItem(
+			WithIdx(chunk.Idx),
+			WithChunkFileId(cf.Id),
+			WithStart(chunk.Start),
+		)
+		ci.Name = chunk.Name
+		ci.Size = chunk.Size
+		ci.MessageId = chunk.MessageId
+		ci.Sha256 = chunk.Sha256
+		ci.Codec = chunk.Codec
+		ci.CompressedSize = chunk.CompressedSize
+		ci.ContentHash = chunk.ContentHash
+		if chunk.FileId != "" {
+			ci.FileId = &chunk.FileId
+		}
+
+		if data, err := os.ReadFile(path.Join(journalPath(cfId), strconv.Itoa(chunk.Idx)+".sent")); err == nil {
+			var sent journalSent
+			if err := json.Unmarshal(data, &sent); err == nil {
+				ci.FileId = &sent.FileId
+				ci.MessageId = sent.MessageId
+				ci.Sha256 = sent.Sha256
+				ci.Codec = sent.Codec
+				ci.CompressedSize = sent.CompressedSize
+				ci.ContentHash = sent.ContentHash
+			}
+		}
+
+		spool, err := os.OpenFile(spoolPath(cfId, chunk.Idx), os.O_RDWR, 0o600)
+		switch {
+		case err == nil:
+			stat, err := spool.Stat()
+			if err != nil {
+				spool.Close()
+				return nil, err
+			}
+			ci.spool = spool
+			ci.Size = int(stat.Size())
+			ci.FileState = SPOOL
+			ci.Dirty = true
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+
+		ci.End = ci.Start + int64(ci.Size)
+		start = ci.End
+		cf.Chunks = append(cf.Chunks, ci)
+		cf.changedChunks = append(cf.changedChunks, ci)
+	}
+	cf.NumChunks = len(cf.Chunks)
+	cf.OriginalSize = int(start)
+	cf.journalStale = true
+	return cf, nil
+}
@@ -0,0 +1,106 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"it.smaso/tgfuse/encryption"
+)
+
+// IsEncrypted tells whether the chunks of the file are stored encrypted
+func (cf *ChunkFile) IsEncrypted() bool {
+	return cf.WrappedKey != ""
+}
+
+// dataKey returns the key encrypting the chunks of the file, unwrapping it on
+// first use. It's nil when the file is not encrypted
+func (cf *ChunkFile) dataKey() ([]byte, error) {
+	if !cf.IsEncrypted() {
+		return nil, nil
+	}
+	cf.keyLock.Lock()
+	defer cf.keyLock.Unlock()
+
+	if cf.key == nil {
+		key, err := encryption.UnwrapKey(cf.WrappedKey, cf.Id)
+		if err != nil {
+			return nil, err
+		}
+		cf.key = key
+	}
+	return cf.key, nil
+}
+
+// initKey gives a data key to a file without uploaded content when encryption
+// is enabled. Files stored in clear keep being stored as they are. Must be
+// called holding writeLock
+func (cf *ChunkFile) initKey() error {
+	if cf.IsEncrypted() || !encryption.Enabled() {
+		return nil
+	}
+	for _, ci := range cf.Chunks {
+		if ci.FileId != nil {
+			return nil
+		}
+	}
+
+	key, wrapped, err := encryption.NewDataKey(cf.Id)
+	if err != nil {
+		return err
+	}
+	cf.keyLock.Lock()
+	cf.key = key
+	cf.WrappedKey = wrapped
+	cf.keyLock.Unlock()
+	cf.metadataChanged = true
+	cf.journalStale = true
+	return nil
+}
+
+// sealedChunk is the content of a chunk as it's sent, compressed and encrypted
+type sealedChunk struct {
+	*chunkUpload
+	reader io.Reader
+	size   int
+}
+
+func (sc *sealedChunk) GetReader() io.Reader {
+	return sc.reader
+}
+
+// GetSize returns the size of what is sent, rather than of the plain content
+func (sc *sealedChunk) GetSize() int {
+	return sc.size
+}
+
+// sendable returns what is sent for the chunk, its content as in content and
+// encrypted with key unless key is nil
+func (u *chunkUpload) sendable(key []byte, content *payload) (*sealedChunk, error) {
+	reader, size := u.GetReader(), u.size
+	if content.data != nil {
+		reader, size = bytes.NewReader(content.data), len(content.data)
+	}
+	if key != nil {
+		var err error
+		if reader, err = encryption.Seal(key, reader, chunkAAD(u.fileId, u.idx)); err != nil {
+			return nil, err
+		}
+		size = encryption.SealedSize(size)
+	}
+	return &sealedChunk{chunkUpload: u, reader: reader, size: size}, nil
+}
+
+// openContent returns the plain content of a downloaded chunk
+func openContent(key, data, aad []byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	return encryption.Open(key, data, aad)
+}
+
+// chunkAAD binds the encrypted content of a chunk to its file and position, so
+// that it can't be served in place of another chunk
+func chunkAAD(fileId string, idx int) []byte {
+	return fmt.Appendf(nil, "%s/%d", fileId, idx)
+}
@@ -0,0 +1,26 @@
+package filesystem
+
+import "github.com/google/uuid"
+
+// Link is an additional name of a file, created by a hard link. The name the
+// file was created with is kept in the ChunkFile itself
+type Link struct {
+	Id       string
+	FileId   string
+	ParentId string
+	Name     string
+}
+
+func NewLink(fileId, parentId, name string) *Link {
+	return &Link{
+		Id:       uuid.NewString(),
+		FileId:   fileId,
+		ParentId: parentId,
+		Name:     name,
+	}
+}
+
+// Is tells whether the link is the entry name inside the folder parentId
+func (l *Link) Is(parentId, name string) bool {
+	return l.ParentId == parentId && l.Name == name
+}
@@ -0,0 +1,52 @@
+package filesystem
+
+import "syscall"
+
+// FileLock is an advisory lock on a range of a file. Owner identifies the
+// holder across every mount, End is inclusive
+type FileLock struct {
+	Owner string
+	Typ   uint32
+	Start uint64
+	End   uint64
+	Pid   uint32
+}
+
+func (l *FileLock) overlaps(other *FileLock) bool {
+	return l.Start <= other.End && other.Start <= l.End
+}
+
+// Conflicts tells whether the lock can't be held together with other. Locks of
+// the same owner never conflict, since a new lock replaces the old one
+func (l *FileLock) Conflicts(other *FileLock) bool {
+	if l.Owner == other.Owner || !l.overlaps(other) {
+		return false
+	}
+	return l.Typ == syscall.F_WRLCK || other.Typ == syscall.F_WRLCK
+}
+
+// ApplyLock returns the locks of an owner after setting lk, which replaces the
+// held locks on its range. A F_UNLCK lock only releases the range
+func ApplyLock(held []FileLock, lk FileLock) []FileLock {
+	locks := []FileLock{}
+	for _, h := range held {
+		if !h.overlaps(&lk) {
+			locks = append(locks, h)
+			continue
+		}
+		if h.Start < lk.Start {
+			before := h
+			before.End = lk.Start - 1
+			locks = append(locks, before)
+		}
+		if h.End > lk.End {
+			after := h
+			after.Start = lk.End + 1
+			locks = append(locks, after)
+		}
+	}
+	if lk.Typ != syscall.F_UNLCK {
+		locks = append(locks, lk)
+	}
+	return locks
+}
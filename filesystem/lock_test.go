@@ -0,0 +1,114 @@
+package filesystem
+
+import (
+	"math"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		lock  FileLock
+		other FileLock
+		want  bool
+	}{
+		{
+			name:  "read locks share a range",
+			lock:  FileLock{Owner: "a", Typ: syscall.F_RDLCK, Start: 0, End: 10},
+			other: FileLock{Owner: "b", Typ: syscall.F_RDLCK, Start: 5, End: 15},
+			want:  false,
+		},
+		{
+			name:  "write lock on a read locked range",
+			lock:  FileLock{Owner: "a", Typ: syscall.F_WRLCK, Start: 0, End: 10},
+			other: FileLock{Owner: "b", Typ: syscall.F_RDLCK, Start: 10, End: 15},
+			want:  true,
+		},
+		{
+			name:  "read lock on a write locked range",
+			lock:  FileLock{Owner: "a", Typ: syscall.F_RDLCK, Start: 0, End: 0},
+			other: FileLock{Owner: "b", Typ: syscall.F_WRLCK, Start: 0, End: math.MaxUint64},
+			want:  true,
+		},
+		{
+			name:  "adjacent ranges",
+			lock:  FileLock{Owner: "a", Typ: syscall.F_WRLCK, Start: 0, End: 9},
+			other: FileLock{Owner: "b", Typ: syscall.F_WRLCK, Start: 10, End: 19},
+			want:  false,
+		},
+		{
+			name:  "same owner",
+			lock:  FileLock{Owner: "a", Typ: syscall.F_WRLCK, Start: 0, End: 10},
+			other: FileLock{Owner: "a", Typ: syscall.F_WRLCK, Start: 0, End: 10},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.lock.Conflicts(&tt.other); got != tt.want {
+				t.Errorf("Conflicts() = %v, want %v", got, tt.want)
+			}
+			if got := tt.other.Conflicts(&tt.lock); got != tt.want {
+				t.Errorf("Conflicts() reversed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyLock(t *testing.T) {
+	lock := func(typ uint32, start, end uint64) FileLock {
+		return FileLock{Owner: "a", Typ: typ, Start: start, End: end}
+	}
+	tests := []struct {
+		name string
+		held []FileLock
+		lk   FileLock
+		want []FileLock
+	}{
+		{
+			name: "first lock",
+			held: nil,
+			lk:   lock(syscall.F_WRLCK, 0, 9),
+			want: []FileLock{lock(syscall.F_WRLCK, 0, 9)},
+		},
+		{
+			name: "disjoint locks are kept",
+			held: []FileLock{lock(syscall.F_RDLCK, 0, 9)},
+			lk:   lock(syscall.F_WRLCK, 20, 29),
+			want: []FileLock{lock(syscall.F_RDLCK, 0, 9), lock(syscall.F_WRLCK, 20, 29)},
+		},
+		{
+			name: "lock in the middle splits the held one",
+			held: []FileLock{lock(syscall.F_RDLCK, 0, 29)},
+			lk:   lock(syscall.F_WRLCK, 10, 19),
+			want: []FileLock{lock(syscall.F_RDLCK, 0, 9), lock(syscall.F_RDLCK, 20, 29), lock(syscall.F_WRLCK, 10, 19)},
+		},
+		{
+			name: "lock covering the held one replaces it",
+			held: []FileLock{lock(syscall.F_RDLCK, 10, 19)},
+			lk:   lock(syscall.F_WRLCK, 0, 29),
+			want: []FileLock{lock(syscall.F_WRLCK, 0, 29)},
+		},
+		{
+			name: "unlock of part of a range",
+			held: []FileLock{lock(syscall.F_WRLCK, 0, 29)},
+			lk:   lock(syscall.F_UNLCK, 0, 9),
+			want: []FileLock{lock(syscall.F_WRLCK, 10, 29)},
+		},
+		{
+			name: "unlock of the whole file",
+			held: []FileLock{lock(syscall.F_WRLCK, 0, 9), lock(syscall.F_RDLCK, 100, math.MaxUint64)},
+			lk:   lock(syscall.F_UNLCK, 0, math.MaxUint64),
+			want: []FileLock{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ApplyLock(tt.held, tt.lk); !slices.Equal(got, tt.want) {
+				t.Errorf("ApplyLock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"it.smaso/tgfuse/configs"
+)
+
+// memoryRetryDelay is how often a reservation waiting for memory looks again
+// for chunks to spill, since chunks that are busy now may be spilled later
+const memoryRetryDelay = 50 * time.Millisecond
+
+// memoryWaitTimeout is how long a reservation waits for memory before failing,
+// since it may be holding the lock of a chunk
+const memoryWaitTimeout = 30 * time.Second
+
+// ErrNoMemory is returned when the memory needed can't be reserved in time
+var ErrNoMemory = fmt.Errorf("memory budget exhausted: %w", syscall.ENOMEM)
+
+// memoryBudget accounts the bytes held by chunk buffers against MEMORY_BUDGET
+type memoryBudget struct {
+	lock sync.Mutex
+	used int64
+	peak int64
+}
+
+var memory = &memoryBudget{}
+
+// reserve accounts size bytes that are about to be held in memory. Past the
+// budget, the buffers of other chunks are spilled to the disk cache first, then
+// the caller waits for them to be released, until ctx is done or for
+// memoryWaitTimeout at most. A single reservation larger than the budget is let
+// through when nothing else is held
+func (m *memoryBudget) reserve(ctx context.Context, size int64) error {
+	return m.wait(ctx, func() bool {
+		if m.used == 0 || m.used+size <= int64(configs.MEMORY_BUDGET) {
+			m.used += size
+			m.peak = max(m.peak, m.used)
+			return true
+		}
+		return false
+	})
+}
+
+// wait spills chunks to the disk cache until done, which is called holding
+// lock, returns true. Gives up once ctx is done or after memoryWaitTimeout
+func (m *memoryBudget) wait(ctx context.Context, done func() bool) error {
+	ctx, cancel := context.WithTimeout(ctx, memoryWaitTimeout)
+	defer cancel()
+
+	for {
+		m.lock.Lock()
+		ok := done()
+		m.lock.Unlock()
+		if ok {
+			return nil
+		}
+
+		if !cache.spillOne() {
+			select {
+			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return ErrNoMemory
+				}
+				return ctx.Err()
+			case <-time.After(memoryRetryDelay):
+			}
+		}
+	}
+}
+
+// WaitForMemory holds back writers while the chunk buffers are over budget, so
+// that uploads can catch up. It fails with ErrNoMemory if memory isn't released
+// in time, or when ctx is done
+func WaitForMemory(ctx context.Context) error {
+	return memory.wait(ctx, func() bool {
+		return memory.used <= int64(configs.MEMORY_BUDGET)
+	})
+}
+
+func (m *memoryBudget) release(size int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.used -= size
+}
+
+// UsageStats reports the local resources held by the chunks
+type UsageStats struct {
+	MemoryUsed   int64 // bytes held by chunk buffers
+	MemoryPeak   int64 // highest value of MemoryUsed since the mount
+	MemoryBudget int64
+	CacheUsed    int64 // bytes of the chunks held locally, see CACHE_MAX_BYTES
+	CacheBudget  int64
+}
+
+// Usage returns the current usage of memory and disk cache
+func Usage() UsageStats {
+	stats := UsageStats{
+		MemoryBudget: int64(configs.MEMORY_BUDGET),
+		CacheUsed:    CacheUsage(),
+		CacheBudget:  int64(configs.CACHE_MAX_BYTES),
+	}
+
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+	stats.MemoryUsed = memory.used
+	stats.MemoryPeak = memory.peak
+	return stats
+}
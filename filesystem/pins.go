@@ -0,0 +1,86 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/logger"
+)
+
+// Pinned files and directories are kept in the cache for offline use. Pins are
+// local to the mount, so they're stored in PINS_FILE instead of the database
+var pins = struct {
+	sync.RWMutex
+	ids    map[string]bool
+	loaded bool
+}{ids: map[string]bool{}}
+
+// loadPins reads PINS_FILE the first time pins are needed. Must be called
+// holding the pins lock
+func loadPins() {
+	if pins.loaded {
+		return
+	}
+	pins.loaded = true
+
+	data, err := os.ReadFile(configs.PINS_FILE)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	var ids []string
+	if err == nil {
+		err = json.Unmarshal(data, &ids)
+	}
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to read pins: %s", err.Error()))
+		return
+	}
+	for _, id := range ids {
+		pins.ids[id] = true
+	}
+}
+
+// IsPinned tells whether the file or directory with the given id is pinned
+// on its own, without looking at the directories containing it
+func IsPinned(id string) bool {
+	pins.RLock()
+	if pins.loaded {
+		defer pins.RUnlock()
+		return pins.ids[id]
+	}
+	pins.RUnlock()
+
+	pins.Lock()
+	defer pins.Unlock()
+	loadPins()
+	return pins.ids[id]
+}
+
+// SetPinned pins or unpins the file or directory with the given id
+func SetPinned(id string, pinned bool) error {
+	pins.Lock()
+	defer pins.Unlock()
+	loadPins()
+
+	if pins.ids[id] == pinned {
+		return nil
+	}
+	if pinned {
+		pins.ids[id] = true
+	} else {
+		delete(pins.ids, id)
+	}
+
+	data, err := json.Marshal(slices.Sorted(maps.Keys(pins.ids)))
+	if err != nil {
+		return err
+	}
+	return writeDurable(configs.PINS_FILE, data)
+}
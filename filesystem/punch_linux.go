@@ -0,0 +1,15 @@
+//go:build linux
+
+package filesystem
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// punchHole frees the disk space used by the given range of the file, which
+// reads as zeros afterwards
+func punchHole(file *os.File, off, size int64) error {
+	return unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, size)
+}
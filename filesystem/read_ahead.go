@@ -0,0 +1,48 @@
+package filesystem
+
+import (
+	"sync"
+
+	"it.smaso/tgfuse/configs"
+)
+
+// sequentialSlack is the distance from the end of the previous read within which
+// a read is still sequential, since the kernel may reorder parallel reads
+const sequentialSlack = 1 << 20 // bytes
+
+// ReadAhead sizes the window of chunks downloaded ahead of the reads of an open
+// file. Each chunk boundary crossed by sequential reads doubles the window up
+// to MAX_READ_AHEAD_CHUNKS, every read elsewhere in the file halves it
+type ReadAhead struct {
+	lock    sync.Mutex
+	started bool
+	next    int64 // offset following the last sequential read
+	window  int
+}
+
+// Window records the read of the bytes between start and end of cf and returns
+// the number of chunks to download after them
+func (ra *ReadAhead) Window(cf *ChunkFile, start, end int64) int {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	if !ra.started {
+		ra.started = true
+		ra.next = end
+		ra.window = configs.READ_AHEAD_CHUNKS
+		return ra.window
+	}
+
+	if start < ra.next-sequentialSlack || start > ra.next+sequentialSlack {
+		ra.next = end
+		ra.window /= 2
+		return ra.window
+	}
+
+	// chunks cut by content have their own size
+	if cf.chunkIndex(end) > cf.chunkIndex(ra.next) {
+		ra.window = min(max(ra.window*2, 1), configs.MAX_READ_AHEAD_CHUNKS)
+	}
+	ra.next = max(ra.next, end)
+	return ra.window
+}
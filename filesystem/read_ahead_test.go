@@ -0,0 +1,81 @@
+package filesystem
+
+import (
+	"slices"
+	"testing"
+
+	"it.smaso/tgfuse/configs"
+)
+
+// chunksOf returns a file cut in chunks of the given sizes
+func chunksOf(sizes ...int) *ChunkFile {
+	cf := &ChunkFile{}
+	var start int64
+	for idx, size := range sizes {
+		ci := NewChunkItem(WithIdx(idx), WithStart(start))
+		ci.Size = size
+		ci.End = start + int64(size)
+		start = ci.End
+		cf.Chunks = append(cf.Chunks, ci)
+	}
+	cf.NumChunks = len(cf.Chunks)
+	cf.OriginalSize = int(start)
+	return cf
+}
+
+func TestReadAheadWindow(t *testing.T) {
+	initial, maxWindow := configs.READ_AHEAD_CHUNKS, configs.MAX_READ_AHEAD_CHUNKS
+	configs.READ_AHEAD_CHUNKS, configs.MAX_READ_AHEAD_CHUNKS = 2, 8
+	t.Cleanup(func() {
+		configs.READ_AHEAD_CHUNKS, configs.MAX_READ_AHEAD_CHUNKS = initial, maxWindow
+	})
+
+	// chunks cut by content, far smaller than CHUNK_SIZE
+	const kib = 1 << 10
+	cf := chunksOf(100*kib, 3000*kib, 50*kib, 2000*kib, 4000*kib)
+
+	tests := []struct {
+		name  string
+		reads [][2]int64
+		want  []int
+	}{
+		{
+			name:  "first read",
+			reads: [][2]int64{{0, 50 * kib}},
+			want:  []int{2},
+		},
+		{
+			name:  "sequential reads within a chunk",
+			reads: [][2]int64{{100 * kib, 600 * kib}, {600 * kib, 1100 * kib}, {1100 * kib, 1600 * kib}},
+			want:  []int{2, 2, 2},
+		},
+		{
+			name:  "sequential reads crossing small chunks",
+			reads: [][2]int64{{0, 50 * kib}, {50 * kib, 150 * kib}, {150 * kib, 3120 * kib}, {3120 * kib, 3200 * kib}},
+			want:  []int{2, 4, 8, 8},
+		},
+		{
+			name:  "read elsewhere in the file",
+			reads: [][2]int64{{0, 50 * kib}, {50 * kib, 150 * kib}, {7000 * kib, 7100 * kib}},
+			want:  []int{2, 4, 2},
+		},
+		{
+			name:  "sequential reads past the last chunk",
+			reads: [][2]int64{{9150 * kib, 9200 * kib}, {9200 * kib, 9300 * kib}},
+			want:  []int{2, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ra ReadAhead
+			got := []int{}
+			for _, read := range tt.reads {
+				got = append(got, ra.Window(cf, read[0], read[1]))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Window() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/logger"
+	"it.smaso/tgfuse/telegram"
+)
+
+// uploadJob is a dirty chunk waiting to be sent by the uploader
+type uploadJob struct {
+	cf *ChunkFile
+	ci *ChunkItem
+}
+
+var (
+	uploadQueue    chan uploadJob
+	startUploaders sync.Once
+)
+
+// enqueueUpload schedules the upload of the chunk on the worker pool, unless it's
+// already queued. Writers are slowed down only when the queue is full
+func (cf *ChunkFile) enqueueUpload(ci *ChunkItem) {
+	if !ci.queued.CompareAndSwap(false, true) {
+		return
+	}
+
+	startUploaders.Do(func() {
+		uploadQueue = make(chan uploadJob, configs.UPLOAD_QUEUE_SIZE)
+		for range configs.UPLOAD_WORKERS {
+			go uploadWorker()
+		}
+	})
+
+	cf.uploads.Add(1)
+	uploadQueue <- uploadJob{cf: cf, ci: ci}
+}
+
+func uploadWorker() {
+	for job := range uploadQueue {
+		job.cf.upload(job.ci)
+	}
+}
+
+// chunkUpload is the content of a dirty chunk taken under its lock, so that it
+// can be sent while the chunk keeps being written
+type chunkUpload struct {
+	fileId  string
+	idx     int
+	name    string
+	size    int
+	version uint64   // version of the chunk the content was taken from
+	file    *os.File // copy of the spool file, deleted once sent
+	data    []byte   // content of chunks that are not spooled
+}
+
+// snapshot copies the current content of the chunk. Must be called holding
+// ci.lock
+func (ci *ChunkItem) snapshot() (*chunkUpload, error) {
+	u := &chunkUpload{fileId: ci.ChunkFileId, idx: ci.Idx, name: ci.Name, size: ci.Size, version: ci.version}
+	if ci.spool == nil {
+		if ci.Buf != nil {
+			u.data = bytes.Clone(ci.Buf.Bytes())
+		}
+		return u, nil
+	}
+
+	file, err := os.OpenFile(ci.spool.Name()+".upload", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, io.NewSectionReader(ci.spool, 0, int64(ci.Size))); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	u.file = file
+	return u, nil
+}
+
+func (u *chunkUpload) GetReader() io.Reader {
+	if u.file != nil {
+		return io.NewSectionReader(u.file, 0, int64(u.size))
+	}
+	return bytes.NewReader(u.data)
+}
+
+func (u *chunkUpload) GetSize() int {
+	return u.size
+}
+
+func (u *chunkUpload) GetName() string {
+	return u.name
+}
+
+// close deletes the copy of the spool file
+func (u *chunkUpload) close() {
+	if u.file == nil {
+		return
+	}
+	u.file.Close()
+	if err := os.Remove(u.file.Name()); err != nil {
+		logger.LogWarn(fmt.Sprintf("Failed to delete upload copy of chunk [%d]: %s", u.idx, err.Error()))
+	}
+}
+
+// sendWithRetry compresses the content and sends it following the default retry
+// policy, returning the document holding it and, when the document is shared
+// through the DedupIndex, the hash it's indexed by. Content already uploaded is
+// not sent again when chunks are deduplicated
+func (u *chunkUpload) sendWithRetry(key []byte) (*DedupEntry, string, error) {
+	// encrypted chunks never match, since every file has its own key
+	var hash string
+	if key == nil && dedup != nil {
+		var err error
+		if hash, err = u.contentHash(); err != nil {
+			return nil, "", err
+		}
+		if doc := u.lookupUploaded(hash); doc != nil {
+			logger.LogInfo(fmt.Sprintf("Chunk [%d] was already uploaded as %s", u.idx, doc.FileId))
+			return doc, hash, nil
+		}
+	}
+
+	content, err := u.compress()
+	if err != nil {
+		return nil, "", err
+	}
+	defer content.release(u.size)
+
+	var doc *DedupEntry
+	err = telegram.DefaultRetryPolicy().Do(fmt.Sprintf("Upload of chunk [%d]", u.idx), func() error {
+		sendable, err := u.sendable(key, content)
+		if err != nil {
+			return err
+		}
+		sent, err := telegram.SendFile(sendable)
+		if err != nil {
+			logger.LogErr(fmt.Sprintf("Chunk [%d] has not been sent", u.idx))
+			return err
+		}
+		doc = &DedupEntry{
+			FileId:         sent.FileId,
+			MessageId:      sent.MessageId,
+			Sha256:         sent.Sha256,
+			Codec:          content.codec,
+			CompressedSize: len(content.data),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if hash != "" && !u.registerUploaded(hash, doc) {
+		hash = ""
+	}
+	logger.LogInfo(fmt.Sprintf("Chunk [%d] sent as %s", u.idx, doc.FileId))
+	return doc, hash, nil
+}
+
+// upload sends the chunk and records it as changed, so that it's stored on the
+// next save of the file. The chunk is locked only while its content is copied
+// and while the upload is recorded, so writes are not held back by the upload.
+// If the chunk is written in the meantime the upload is discarded and the chunk
+// stays dirty
+func (cf *ChunkFile) upload(ci *ChunkItem) {
+	defer cf.uploads.Done()
+	defer ci.queued.Store(false)
+
+	ci.lock.Lock()
+	// the chunk may have been dropped by a truncate in the meantime
+	if !ci.Dirty {
+		ci.lock.Unlock()
+		return
+	}
+	snapshot, err := ci.snapshot()
+	ci.lock.Unlock()
+
+	var doc *DedupEntry
+	var hash string
+	if err == nil {
+		defer snapshot.close()
+		var key []byte
+		if key, err = cf.dataKey(); err == nil {
+			doc, hash, err = snapshot.sendWithRetry(key)
+		}
+	}
+	if err != nil {
+		// the chunk stays dirty and is sent again by the next save
+		logger.LogErr(fmt.Sprintf("Failed to upload chunk [%d] of %s: %s", ci.Idx, cf.OriginalFilename, err.Error()))
+		cf.changesLock.Lock()
+		cf.uploadErr = err
+		cf.changesLock.Unlock()
+		return
+	}
+
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	if !ci.Dirty || ci.version != snapshot.version {
+		logger.LogInfo(fmt.Sprintf("Chunk [%d] of %s changed while being uploaded, discarding the upload", ci.Idx, cf.OriginalFilename))
+		if err := releaseRemote(remoteRef{MessageId: doc.MessageId, ContentHash: hash}); err != nil {
+			logger.LogWarn(fmt.Sprintf("Failed to delete discarded message %d: %s", doc.MessageId, err.Error()))
+		}
+		return
+	}
+
+	old := ci.remoteRef()
+	ci.uploaded(doc, hash)
+	cf.journalSent(ci)
+	// keeps the temporary file aligned with the new content
+	ci.releaseSpool(cf)
+	logger.LogInfo(fmt.Sprintf("Uploaded chunk [%d] of %s in background", ci.Idx, cf.OriginalFilename))
+
+	if old.MessageId != 0 {
+		cf.changesLock.Lock()
+		cf.staleMessages = append(cf.staleMessages, old)
+		cf.changesLock.Unlock()
+	}
+	cf.markChanged(ci)
+}
@@ -0,0 +1,60 @@
+package filesystem
+
+import (
+	"maps"
+	"slices"
+)
+
+// GetXattr returns the value of the extended attribute with the given name
+func (cf *ChunkFile) GetXattr(name string) ([]byte, bool) {
+	cf.xattrLock.RLock()
+	defer cf.xattrLock.RUnlock()
+	val, ok := cf.xattrs[name]
+	return val, ok
+}
+
+// Xattrs returns a copy of all the extended attributes of the file
+func (cf *ChunkFile) Xattrs() map[string][]byte {
+	cf.xattrLock.RLock()
+	defer cf.xattrLock.RUnlock()
+	return maps.Clone(cf.xattrs)
+}
+
+// XattrNames returns the sorted names of the extended attributes of the file
+func (cf *ChunkFile) XattrNames() []string {
+	cf.xattrLock.RLock()
+	defer cf.xattrLock.RUnlock()
+	return slices.Sorted(maps.Keys(cf.xattrs))
+}
+
+func (cf *ChunkFile) SetXattr(name string, value []byte) {
+	cf.xattrLock.Lock()
+	defer cf.xattrLock.Unlock()
+	if cf.xattrs == nil {
+		cf.xattrs = map[string][]byte{}
+	}
+	cf.xattrs[name] = slices.Clone(value)
+}
+
+// RemoveXattr deletes the extended attribute, returning whether it existed
+func (cf *ChunkFile) RemoveXattr(name string) bool {
+	cf.xattrLock.Lock()
+	defer cf.xattrLock.Unlock()
+	_, ok := cf.xattrs[name]
+	delete(cf.xattrs, name)
+	return ok
+}
+
+// ChunkStates returns where each chunk of the file currently is
+func (cf *ChunkFile) ChunkStates() []Status {
+	cf.writeLock.Lock()
+	defer cf.writeLock.Unlock()
+
+	states := make([]Status, len(cf.Chunks))
+	for idx, ci := range cf.Chunks {
+		ci.lock.RLock()
+		states[idx] = ci.FileState
+		ci.lock.RUnlock()
+	}
+	return states
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -12,6 +11,8 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"it.smaso/tgfuse/configs"
 	db "it.smaso/tgfuse/database"
+	"it.smaso/tgfuse/encryption"
+	"it.smaso/tgfuse/filesystem"
 	"it.smaso/tgfuse/logger"
 	"it.smaso/tgfuse/services"
 	"it.smaso/tgfuse/tgfuse"
@@ -24,19 +25,54 @@ func main() {
 		os.Exit(1)
 	}
 
-	checkTmpDir()
+	if !filesystem.IsValidCodec(configs.COMPRESSION) {
+		logger.LogErr(fmt.Sprintf("Unknown compression codec %q", configs.COMPRESSION))
+		os.Exit(1)
+	}
 
-	root := tgfuse.NewRoot()
+	if !filesystem.IsValidChunking(configs.CHUNKING) {
+		logger.LogErr(fmt.Sprintf("Unknown chunking strategy %q", configs.CHUNKING))
+		os.Exit(1)
+	}
+
+	if configs.ENCRYPT_METADATA && !encryption.Enabled() {
+		logger.LogErr("Encrypting metadata needs an encryption key")
+		os.Exit(1)
+	}
 
 	database := db.Connect(configs.DB_CONFIG)
 	logger.LogInfo("Connected to database")
+	// a missing or wrong key is reported now rather than on the first write
+	if encryption.Enabled() {
+		encryption.SetSaltStore(database)
+		if _, err := encryption.MasterKey(); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to load encryption key: %s", err.Error()))
+			os.Exit(1)
+		}
+	}
+	if configs.DEDUPLICATE_CHUNKS {
+		filesystem.SetDedupIndex(database)
+	}
 
-	// go StartMemoryChecker()
+	// pending uploads are completed before the files are loaded, without
+	// holding back the mount
+	replayed := filesystem.ReplayJournal(func(cf *filesystem.ChunkFile) error {
+		return database.UpdateChunks(cf, cf.Chunks)
+	})
+	checkCacheDir()
+
+	root := tgfuse.NewRoot()
+
+	if configs.STATS_ADDR != "" {
+		go services.StartStatsServer(configs.STATS_ADDR)
+	}
 	// go services.StartGarbageCollector(root)
 
 	server, err := fs.Mount(args[1], root, &fs.Options{
 		MountOptions: fuse.MountOptions{
 			FsName: "tgfuse",
+			// locks are forwarded so that they are shared with the other mounts
+			EnableLocks: true,
 		},
 		UID: uint32(os.Getuid()),
 		GID: uint32(os.Getgid()),
@@ -61,24 +97,34 @@ func main() {
 	}()
 
 	go func() {
-		files, _ := database.GetAllChunkFiles()
-		for idx := range *files {
-			ctx := context.Background()
-			file := tgfuse.CfInode{File: (*files)[idx]}
-
-			ch := root.NewInode(
-				ctx,
-				&file,
-				fs.StableAttr{Mode: syscall.S_IFREG | 0o755},
-			)
-			filename := (*files)[idx].OriginalFilename
-			root.AddChild(filename, ch, true)
-
-			// root.Nodes[(*files)[idx].OriginalFilename] = &file
-			root.Nodes[filename] = &file
-			// root.CfChildren[filename] = &file
+		<-replayed
+		dirs, err := database.GetAllDirectories()
+		if err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to retrieve directories: %s", err.Error()))
+		} else {
+			root.AddDirectories(*dirs)
+		}
+
+		files, err := database.GetAllChunkFiles()
+		if err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to retrieve files: %s", err.Error()))
+		} else {
+			known := map[string]bool{}
+			for idx := range *files {
+				root.AddFile((*files)[idx])
+				known[(*files)[idx].Id] = true
+			}
+			filesystem.PruneCache(func(cfId string) bool { return known[cfId] })
+		}
+
+		links, err := database.GetAllLinks()
+		if err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to retrieve links: %s", err.Error()))
+		} else {
+			root.AddLinks(*links)
 		}
 		logger.LogInfo("Added all the entries to root")
+		go root.PrefetchPinned()
 
 		go func() {
 			time.Sleep(5 * time.Second)
@@ -94,18 +140,12 @@ func main() {
 	server.Wait()
 }
 
-func checkTmpDir() {
-	logger.LogInfo("Checking existance of temporary folder")
-
-	if _, err := os.Stat(configs.TMP_FILE_FOLDER); err == nil {
-		if err := os.RemoveAll(configs.TMP_FILE_FOLDER); err != nil {
-			panic(fmt.Sprintf("Failed to delete temp folder: %s", err.Error()))
-		}
-	}
+func checkCacheDir() {
+	logger.LogInfo("Checking existance of cache folder")
 
-	if err := os.MkdirAll(configs.TMP_FILE_FOLDER, 0o755); err != nil {
-		logger.LogErr(fmt.Sprintf("Failed to create tmp dir: %s", err.Error()))
+	if err := os.MkdirAll(configs.CACHE_FOLDER, 0o755); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to create cache dir: %s", err.Error()))
 	} else {
-		logger.LogInfo("Created temporary folder")
+		logger.LogInfo("Cache folder is ready")
 	}
 }
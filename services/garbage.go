@@ -9,15 +9,12 @@ import (
 
 func StartGarbageCollector(rootNode *tgfuse.RootNode) {
 	for {
-		nodes := rootNode.Children()
-		for name := range nodes {
-			if node, ok := rootNode.Nodes[name]; ok {
-				if node.File.ReadyToClean() {
-					node.File.DeleteTmpFile()
-				}
-				if node.ReadyForCleanup() {
-					node.ClearBuffers()
-				}
+		for _, node := range rootNode.GetFiles() {
+			if node.File.ReadyToClean() {
+				node.File.DeleteTmpFile()
+			}
+			if node.ReadyForCleanup() {
+				node.ClearBuffers()
 			}
 		}
 		time.Sleep(time.Duration(configs.GC_DELAY) * time.Second)
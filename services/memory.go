@@ -1,33 +0,0 @@
-package services
-
-import (
-	"fmt"
-	"os"
-	"runtime"
-	"time"
-
-	"it.smaso/tgfuse/logger"
-)
-
-func StartMemoryChecker() {
-	logger.LogInfo("Starting memory checker")
-	file, err := os.OpenFile("/Users/antlia/Development/tgfuse_go/stats.csv", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
-	if err != nil {
-		file, _ = os.Create("/Users/antlia/Development/tgfuse_go/stats.csv")
-	}
-	_, _ = file.WriteString("time,heap alloc,heap sys,heap in use\n")
-	_ = file.Close()
-
-	for {
-		stats := &runtime.MemStats{}
-		runtime.ReadMemStats(stats)
-		writeToFile(stats)
-		time.Sleep(1 * time.Second)
-	}
-}
-
-func writeToFile(stats *runtime.MemStats) {
-	file, _ := os.OpenFile("/Users/antlia/Development/tgfuse_go/stats.csv", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
-	defer file.Close()
-	_, _ = file.WriteString(fmt.Sprintf("%d,%d,%d,%d\n", time.Now().UnixMilli(), stats.HeapAlloc, stats.HeapSys, stats.HeapInuse))
-}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"it.smaso/tgfuse/filesystem"
+	"it.smaso/tgfuse/logger"
+)
+
+// Stats is the usage of the mount served by StartStatsServer
+type Stats struct {
+	filesystem.UsageStats
+	HeapAlloc uint64
+	HeapSys   uint64
+	HeapInuse uint64
+}
+
+// StartStatsServer serves the current usage of memory and cache as json at
+// /stats on the given address
+func StartStatsServer(addr string) {
+	logger.LogInfo(fmt.Sprintf("Serving stats on %s", addr))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		mem := &runtime.MemStats{}
+		runtime.ReadMemStats(mem)
+		stats := Stats{
+			UsageStats: filesystem.Usage(),
+			HeapAlloc:  mem.HeapAlloc,
+			HeapSys:    mem.HeapSys,
+			HeapInuse:  mem.HeapInuse,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to write stats: %s", err.Error()))
+		}
+	})
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.LogErr(fmt.Sprintf("Stats server stopped: %s", err.Error()))
+	}
+}
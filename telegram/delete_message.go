@@ -0,0 +1,27 @@
+package telegram
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"it.smaso/tgfuse/configs"
+)
+
+// DeleteMessage removes from the chat the message with the given id, together
+// with the document attached to it
+func DeleteMessage(messageId int) error {
+	endpoint := fmt.Sprintf("https://api.telegram.org/bot%s/deleteMessage", configs.TG_BOT_TOKEN)
+
+	resp, err := http.PostForm(endpoint, url.Values{
+		"chat_id":    {configs.TG_CHAT_ID},
+		"message_id": {strconv.Itoa(messageId)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return decodeResponse(resp, &apiResponse{})
+}
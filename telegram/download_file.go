@@ -2,7 +2,8 @@ package telegram
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,20 +15,29 @@ import (
 var instance *Telegram
 
 type Telegram struct {
-	sem chan int
+	sem *slots
 }
 
 func GetInstance() *Telegram {
 	if instance == nil {
 		instance = &Telegram{
-			sem: make(chan int, 5),
+			sem: newSlots(5),
 		}
 	}
 	return instance
 }
 
+// Reschedule hands the free download slots again, to be called when a waiting
+// download becomes urgent
+func (tg *Telegram) Reschedule() {
+	tg.sem.lock.Lock()
+	defer tg.sem.lock.Unlock()
+	tg.sem.dispatch()
+}
+
 func getFilePath(fileId string) (*string, error) {
 	type response struct {
+		apiResponse
 		Result struct {
 			FilePath string `json:"file_path"`
 		} `json:"result"`
@@ -46,23 +56,50 @@ func getFilePath(fileId string) (*string, error) {
 	}
 	defer resp.Body.Close()
 
-	respBody, _ := io.ReadAll(resp.Body)
 	jResp := response{}
-	if err := json.Unmarshal(respBody, &jResp); err != nil {
+	if err := decodeResponse(resp, &jResp); err != nil {
 		return nil, err
 	}
 
 	return &jResp.Result.FilePath, nil
 }
 
-func (tg *Telegram) DownloadFile(fileId string) (*[]byte, error) {
-	tg.sem <- 1
-	defer func() { <-tg.sem }()
+// DownloadFile returns the content of the file, retrying as the default policy
+// says. Downloads wait for a free slot, serving first the ones for which urgent
+// is true. Unless checksum is empty, content not matching it is downloaded again
+func (tg *Telegram) DownloadFile(fileId, checksum string, urgent func() bool) (*[]byte, error) {
+	buf := &bytes.Buffer{}
+	err := DefaultRetryPolicy().Do(fmt.Sprintf("Download of %s", fileId), func() error {
+		buf.Reset()
+		return tg.download(fileId, checksum, buf, urgent)
+	})
+	if err != nil {
+		return nil, err
+	}
+	respBody := buf.Bytes()
+	return &respBody, nil
+}
+
+// DownloadTo writes the content of the file to w starting from offset 0,
+// retrying as the default policy says. Every attempt writes from the start.
+// Someone is always waiting for these downloads, so they're urgent. The content
+// is verified as in DownloadFile
+func (tg *Telegram) DownloadTo(fileId, checksum string, w io.WriterAt) error {
+	return DefaultRetryPolicy().Do(fmt.Sprintf("Download of %s", fileId), func() error {
+		return tg.download(fileId, checksum, io.NewOffsetWriter(w, 0), Urgent)
+	})
+}
+
+// download streams the content of the file to w, then compares its sha256 with
+// checksum if given
+func (tg *Telegram) download(fileId, checksum string, w io.Writer, urgent func() bool) error {
+	tg.sem.acquire(urgent)
+	defer tg.sem.release()
 
 	filePath, err := getFilePath(fileId)
 	if err != nil {
 		logger.LogErr(fmt.Sprintf("Failed to get file path: %s", err))
-		return nil, err
+		return err
 	}
 
 	url := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", configs.TG_BOT_TOKEN, *filePath)
@@ -70,16 +107,25 @@ func (tg *Telegram) DownloadFile(fileId string) (*[]byte, error) {
 	req, err := http.NewRequest("GET", url, &bytes.Buffer{})
 	if err != nil {
 		logger.LogErr(fmt.Sprintf("Failed to create request: %s", err))
-		return nil, err
+		return err
 	}
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		logger.LogErr(fmt.Sprintf("Failed to send request: %s", err))
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	respBody, _ := io.ReadAll(resp.Body)
-	return &respBody, nil
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), resp.Body); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); checksum != "" && actual != checksum {
+		return &ChecksumError{FileId: fileId, Expected: checksum, Actual: actual}
+	}
+	return nil
 }
@@ -0,0 +1,110 @@
+package telegram
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DEFAULT_RETRY_AFTER is the seconds waited when telegram asks to slow down
+// without saying for how long
+const DEFAULT_RETRY_AFTER = 8
+
+type TooManyRequestsError struct {
+	Timeout int
+}
+
+func (t *TooManyRequestsError) Error() string {
+	return fmt.Sprintf("Too many requests: retry after %d", t.Timeout)
+}
+
+// APIError is a request refused by telegram. Code follows the http status codes
+type APIError struct {
+	Code        int
+	Description string
+}
+
+func (a *APIError) Error() string {
+	return fmt.Sprintf("telegram error %d: %s", a.Code, a.Description)
+}
+
+// Permanent tells whether the request would fail again if retried
+func (a *APIError) Permanent() bool {
+	return a.Code >= 400 && a.Code < 500
+}
+
+// ChecksumError is a download whose content doesn't match the checksum computed
+// when it was uploaded, usually because the body was cut short
+type ChecksumError struct {
+	FileId   string
+	Expected string
+	Actual   string
+}
+
+func (c *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", c.FileId, c.Expected, c.Actual)
+}
+
+// apiResponse contains the fields shared by every response of the bot api
+type apiResponse struct {
+	Ok          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+func (r *apiResponse) err() error {
+	if r.Ok {
+		return nil
+	}
+	if r.ErrorCode == http.StatusTooManyRequests {
+		if r.Parameters.RetryAfter == 0 {
+			return &TooManyRequestsError{Timeout: DEFAULT_RETRY_AFTER}
+		}
+		return &TooManyRequestsError{Timeout: r.Parameters.RetryAfter}
+	}
+	return &APIError{Code: r.ErrorCode, Description: r.Description}
+}
+
+// decodeResponse reads the response into v, which must embed apiResponse, and
+// returns the error reported by telegram if any
+func decodeResponse(resp *http.Response, v interface{ err() error }) error {
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(respBody, v); err != nil {
+		// proxies in front of the api answer with html pages
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return statusError(resp)
+		}
+		return &APIError{Code: resp.StatusCode, Description: fmt.Sprintf("failed to unmarshal response: %s", err.Error())}
+	}
+	return v.err()
+}
+
+// statusError returns the error of a response without a body from the bot api,
+// such as the ones of the file endpoint. Rate limiting waits for the time in
+// the Retry-After header, given either in seconds or as a date
+func statusError(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return &APIError{Code: resp.StatusCode, Description: resp.Status}
+	}
+
+	header := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return &TooManyRequestsError{Timeout: seconds}
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if seconds := int(math.Ceil(time.Until(date).Seconds())); seconds > 0 {
+			return &TooManyRequestsError{Timeout: seconds}
+		}
+	}
+	return &TooManyRequestsError{Timeout: DEFAULT_RETRY_AFTER}
+}
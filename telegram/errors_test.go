@@ -0,0 +1,51 @@
+package telegram
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		timeout    int // expected wait of a TooManyRequestsError, 0 for an APIError
+		permanent  bool
+	}{
+		{name: "retry after seconds", status: http.StatusTooManyRequests, retryAfter: "42", timeout: 42},
+		{name: "retry after date", status: http.StatusTooManyRequests, retryAfter: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), timeout: 60},
+		{name: "missing retry after", status: http.StatusTooManyRequests, timeout: DEFAULT_RETRY_AFTER},
+		{name: "malformed retry after", status: http.StatusTooManyRequests, retryAfter: "soon", timeout: DEFAULT_RETRY_AFTER},
+		{name: "not found", status: http.StatusNotFound, permanent: true},
+		{name: "bad gateway", status: http.StatusBadGateway, permanent: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Status: http.StatusText(tt.status), Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			err := statusError(resp)
+
+			var tooManyRequests *TooManyRequestsError
+			var apiErr *APIError
+			switch {
+			case tt.timeout != 0:
+				if !errors.As(err, &tooManyRequests) {
+					t.Fatalf("statusError() = %v, want a TooManyRequestsError", err)
+				}
+				// a date is rounded to the next second
+				if tooManyRequests.Timeout < tt.timeout || tooManyRequests.Timeout > tt.timeout+1 {
+					t.Errorf("Timeout = %d, want %d", tooManyRequests.Timeout, tt.timeout)
+				}
+			case !errors.As(err, &apiErr):
+				t.Fatalf("statusError() = %v, want an APIError", err)
+			case apiErr.Permanent() != tt.permanent:
+				t.Errorf("Permanent() = %v, want %v", apiErr.Permanent(), tt.permanent)
+			}
+		})
+	}
+}
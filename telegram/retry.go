@@ -0,0 +1,77 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"it.smaso/tgfuse/configs"
+	"it.smaso/tgfuse/logger"
+)
+
+// RetryPolicy describes how failed requests to telegram are repeated. The delay
+// between attempts grows exponentially with some jitter, unless telegram asks
+// to wait for a given time
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxElapsed  time.Duration // gives up instead of waiting past this time since the first attempt
+}
+
+// DefaultRetryPolicy returns the policy set in the configs
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: configs.RETRY_MAX_ATTEMPTS,
+		BaseDelay:   time.Duration(configs.RETRY_BASE_DELAY) * time.Millisecond,
+		MaxDelay:    time.Duration(configs.RETRY_MAX_DELAY) * time.Second,
+		MaxElapsed:  time.Duration(configs.RETRY_MAX_ELAPSED) * time.Second,
+	}
+}
+
+// Do runs op until it succeeds or the policy gives up, returning the last error.
+// Errors that would happen again, like a refused document, are not retried
+func (p RetryPolicy) Do(description string, op func() error) error {
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Permanent() {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		var tooManyRequests *TooManyRequestsError
+		if errors.As(err, &tooManyRequests) {
+			delay = max(delay, time.Duration(tooManyRequests.Timeout)*time.Second)
+		}
+		if p.MaxElapsed > 0 && time.Since(started)+delay > p.MaxElapsed {
+			return err
+		}
+
+		logger.LogWarn(fmt.Sprintf("%s failed (attempt %d of %d), retrying in %s: %s", description, attempt, p.MaxAttempts, delay, err.Error()))
+		time.Sleep(delay)
+	}
+}
+
+// backoff returns the delay after the given attempt, picked at random in the
+// upper half of the exponential delay so that clients don't retry in lockstep
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	// the base delay is doubled only while it can't overflow past the maximum
+	if attempt < 64 && p.BaseDelay <= p.MaxDelay>>(attempt-1) {
+		delay = p.BaseDelay << (attempt - 1)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
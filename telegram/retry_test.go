@@ -0,0 +1,62 @@
+package telegram
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration // upper bound of the delay, which is at least half of it
+	}{
+		{
+			name:    "first attempt waits the base delay",
+			policy:  RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Minute},
+			attempt: 1,
+			want:    100 * time.Millisecond,
+		},
+		{
+			name:    "delay doubles on every attempt",
+			policy:  RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Minute},
+			attempt: 4,
+			want:    800 * time.Millisecond,
+		},
+		{
+			name:    "delay is capped",
+			policy:  RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second},
+			attempt: 5,
+			want:    10 * time.Second,
+		},
+		{
+			name:    "shift past the size of the delay",
+			policy:  RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute},
+			attempt: 100,
+			want:    time.Minute,
+		},
+		{
+			name:    "shift overflowing the delay",
+			policy:  RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Hour},
+			attempt: 31,
+			want:    time.Hour,
+		},
+		{
+			name:    "no delay",
+			policy:  RetryPolicy{},
+			attempt: 3,
+			want:    0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 100 {
+				got := tt.policy.backoff(tt.attempt)
+				if got < tt.want/2 || got > tt.want {
+					t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.attempt, got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
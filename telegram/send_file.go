@@ -1,67 +1,56 @@
 package telegram
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"strconv"
-	"strings"
 
 	"it.smaso/tgfuse/configs"
-	"it.smaso/tgfuse/logger"
 )
 
-type TooManyRequestsError struct {
-	Timeout int
-}
-
-func (t *TooManyRequestsError) Error() string {
-	return fmt.Sprintf("Too many requests: retry after %d", t.Timeout)
-}
-
 type sendResponse struct {
-	Ok          bool   `json:"ok"`
-	ErrorCode   int    `json:"error_code"`
-	Description string `json:"description"`
-	Result      struct {
-		Document struct {
+	apiResponse
+	Result struct {
+		MessageId int `json:"message_id"`
+		Document  struct {
 			FileId string `json:"file_id"`
 		} `json:"document"`
 	} `json:"result"`
 }
 
-func SendFile(ci Sendable) (*string, error) {
-	buf := ci.GetBuffer()
-	if buf == nil || buf.Len() == 0 {
+// SentFile contains the references to a document sent to the chat
+type SentFile struct {
+	FileId    string
+	MessageId int
+	Sha256    string // hex digest of the content sent
+}
+
+// SendFile uploads the content of ci as a document. The multipart body is
+// written through a pipe while the request is sent, so that the content is
+// streamed instead of being copied in memory. The checksum of the content is
+// computed while it's sent
+func SendFile(ci Sendable) (*SentFile, error) {
+	if ci.GetSize() == 0 {
 		return nil, fmt.Errorf("missing buffer to send")
 	}
 
 	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendDocument", configs.TG_BOT_TOKEN)
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	if err := writer.WriteField("chat_id", configs.TG_CHAT_ID); err != nil {
-		return nil, fmt.Errorf("failed to write chat_id: %s", err.Error())
-	}
-
-	if err := writer.WriteField("caption", "Part file"); err != nil {
-		return nil, fmt.Errorf("failed to write caption: %s", err.Error())
-	}
+	body, pipe := io.Pipe()
+	defer body.Close()
+	writer := multipart.NewWriter(pipe)
 
-	part, err := writer.CreateFormFile("document", ci.GetName())
-	if err != nil {
-		return nil, fmt.Errorf("failed to create form file: %s", err.Error())
-	}
-	if _, err := io.Copy(part, buf); err != nil {
-		return nil, fmt.Errorf("failed to copy file buffer: %s", err.Error())
-	}
-	if writer.Close() != nil {
-		return nil, fmt.Errorf("failed to close writer")
-	}
+	hash := sha256.New()
+	written := make(chan error, 1)
+	go func() {
+		err := writeDocument(writer, documentName(ci), io.TeeReader(ci.GetReader(), hash))
+		pipe.CloseWithError(err)
+		written <- err
+	}()
 
 	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
@@ -76,30 +65,55 @@ func SendFile(ci Sendable) (*string, error) {
 	}
 	defer resp.Body.Close()
 
-	respBody, _ := io.ReadAll(resp.Body)
-
 	var jsonResp sendResponse
-	if err := json.Unmarshal(respBody, &jsonResp); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %s", err.Error())
+	if err := decodeResponse(resp, &jsonResp); err != nil {
+		return nil, err
 	}
-
-	fileID := jsonResp.Result.Document.FileId
-	if jsonResp.Ok {
-		return &fileID, nil
+	// the whole body was read, so the content is hashed as well
+	if err := <-written; err != nil {
+		return nil, err
 	}
+	return &SentFile{
+		FileId:    jsonResp.Result.Document.FileId,
+		MessageId: jsonResp.Result.MessageId,
+		Sha256:    hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
 
-	logger.LogInfo(fmt.Sprintf("FileID: %s", fileID))
+// writeDocument writes the multipart body of a sendDocument request
+func writeDocument(writer *multipart.Writer, name string, content io.Reader) error {
+	if err := writer.WriteField("chat_id", configs.TG_CHAT_ID); err != nil {
+		return fmt.Errorf("failed to write chat_id: %s", err.Error())
+	}
 
-	if strings.Contains(jsonResp.Description, "too Many Requests") {
-		comps := strings.Split(jsonResp.Description, " ")
-		duration := comps[len(comps)-1]
-		durationVal, err := strconv.Atoi(duration)
-		if err != nil {
-			logger.LogErr(fmt.Sprintf("Failed to convert %s to int", duration))
-			return nil, &TooManyRequestsError{Timeout: 8}
+	// with encrypted metadata the documents carry no caption at all
+	if !configs.ENCRYPT_METADATA {
+		if err := writer.WriteField("caption", "Part file"); err != nil {
+			return fmt.Errorf("failed to write caption: %s", err.Error())
 		}
-		return nil, &TooManyRequestsError{Timeout: durationVal}
-	} else {
-		return nil, fmt.Errorf("%s", jsonResp.Description)
 	}
+
+	part, err := writer.CreateFormFile("document", name)
+	if err != nil {
+		return fmt.Errorf("failed to create form file: %s", err.Error())
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return fmt.Errorf("failed to copy file buffer: %s", err.Error())
+	}
+	if writer.Close() != nil {
+		return fmt.Errorf("failed to close writer")
+	}
+	return nil
+}
+
+// documentName returns the name the document is sent with. When metadata is
+// encrypted the name is random, so that documents can't be matched with the
+// chunks stored in the database
+func documentName(ci Sendable) string {
+	if !configs.ENCRYPT_METADATA {
+		return ci.GetName()
+	}
+	name := make([]byte, 16)
+	rand.Read(name)
+	return hex.EncodeToString(name)
 }
@@ -1,8 +1,9 @@
 package telegram
 
-import "bytes"
+import "io"
 
 type Sendable interface {
-	GetBuffer() *bytes.Buffer
+	GetReader() io.Reader
+	GetSize() int
 	GetName() string
 }
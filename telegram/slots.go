@@ -0,0 +1,66 @@
+package telegram
+
+import (
+	"slices"
+	"sync"
+)
+
+// slots hands out the download slots shared by every file. Urgent requests,
+// the ones a reader is waiting for, are served before prefetching
+type slots struct {
+	lock    sync.Mutex
+	free    int
+	waiting []*slotRequest
+}
+
+type slotRequest struct {
+	urgent func() bool // checked at every dispatch, a prefetch can become urgent
+	ready  chan struct{}
+}
+
+func newSlots(size int) *slots {
+	return &slots{free: size}
+}
+
+func (s *slots) acquire(urgent func() bool) {
+	req := &slotRequest{urgent: urgent, ready: make(chan struct{})}
+	s.lock.Lock()
+	s.waiting = append(s.waiting, req)
+	s.dispatch()
+	s.lock.Unlock()
+	<-req.ready
+}
+
+func (s *slots) release() {
+	s.lock.Lock()
+	s.free++
+	s.dispatch()
+	s.lock.Unlock()
+}
+
+// dispatch hands the free slots to the waiting requests, urgent ones first in
+// order of arrival. The last free slot is kept for urgent requests, so that a
+// read never waits for prefetching to finish. Must be called holding lock
+func (s *slots) dispatch() {
+	for s.free > 0 && len(s.waiting) > 0 {
+		idx := slices.IndexFunc(s.waiting, func(req *slotRequest) bool {
+			return req.urgent()
+		})
+		if idx < 0 {
+			if s.free == 1 {
+				return
+			}
+			idx = 0
+		}
+
+		req := s.waiting[idx]
+		s.waiting = slices.Delete(s.waiting, idx, idx+1)
+		s.free--
+		close(req.ready)
+	}
+}
+
+// Urgent is the priority of downloads a reader is waiting for
+func Urgent() bool {
+	return true
+}
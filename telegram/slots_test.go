@@ -0,0 +1,116 @@
+package telegram
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSlotsDispatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		free    int
+		urgent  []bool // priority of the waiting requests, in order of arrival
+		served  []int  // requests given a slot
+		waiting int
+	}{
+		{
+			name:    "no free slots",
+			free:    0,
+			urgent:  []bool{true, false},
+			served:  []int{},
+			waiting: 2,
+		},
+		{
+			name:    "urgent requests first",
+			free:    2,
+			urgent:  []bool{false, true, false, true},
+			served:  []int{1, 3},
+			waiting: 2,
+		},
+		{
+			name:    "last slot is kept for urgent requests",
+			free:    1,
+			urgent:  []bool{false, false},
+			served:  []int{},
+			waiting: 2,
+		},
+		{
+			name:    "prefetch in order of arrival",
+			free:    3,
+			urgent:  []bool{false, false, false},
+			served:  []int{0, 1},
+			waiting: 1,
+		},
+		{
+			name:    "urgent request takes the last slot",
+			free:    1,
+			urgent:  []bool{false, true},
+			served:  []int{1},
+			waiting: 1,
+		},
+		{
+			name:    "more slots than requests",
+			free:    4,
+			urgent:  []bool{true, false},
+			served:  []int{0, 1},
+			waiting: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSlots(tt.free)
+			reqs := []*slotRequest{}
+			for _, urgent := range tt.urgent {
+				req := &slotRequest{urgent: func() bool { return urgent }, ready: make(chan struct{})}
+				reqs = append(reqs, req)
+				s.waiting = append(s.waiting, req)
+			}
+
+			s.lock.Lock()
+			s.dispatch()
+			s.lock.Unlock()
+
+			served := []int{}
+			for idx, req := range reqs {
+				select {
+				case <-req.ready:
+					served = append(served, idx)
+				default:
+				}
+			}
+			if !slices.Equal(served, tt.served) {
+				t.Errorf("served = %v, want %v", served, tt.served)
+			}
+			if len(s.waiting) != tt.waiting {
+				t.Errorf("waiting = %d, want %d", len(s.waiting), tt.waiting)
+			}
+			if s.free != tt.free-len(tt.served) {
+				t.Errorf("free = %d, want %d", s.free, tt.free-len(tt.served))
+			}
+		})
+	}
+}
+
+func TestSlotsRelease(t *testing.T) {
+	s := newSlots(1)
+	s.acquire(Urgent)
+
+	prefetch := &slotRequest{urgent: func() bool { return false }, ready: make(chan struct{})}
+	s.lock.Lock()
+	s.waiting = append(s.waiting, prefetch)
+	s.lock.Unlock()
+
+	// the only slot is never given to a prefetch
+	s.release()
+	select {
+	case <-prefetch.ready:
+		t.Fatal("prefetch got the last slot")
+	default:
+	}
+
+	s.acquire(Urgent)
+	s.release()
+	if s.free != 1 || len(s.waiting) != 1 {
+		t.Errorf("free = %d, waiting = %d, want 1 and 1", s.free, len(s.waiting))
+	}
+}
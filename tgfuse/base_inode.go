@@ -1,17 +1,17 @@
 package tgfuse
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"syscall"
-	"time"
 
-	"github.com/google/uuid"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"it.smaso/tgfuse/configs"
 	db "it.smaso/tgfuse/database"
+	"it.smaso/tgfuse/encryption"
 	"it.smaso/tgfuse/filesystem"
 	"it.smaso/tgfuse/logger"
 	"it.smaso/tgfuse/telegram"
@@ -19,13 +19,16 @@ import (
 
 type virtualInode struct {
 	fs.Inode
-	data         []byte
-	name         string
-	mode         uint32
-	cf           *filesystem.ChunkFile
-	currentChunk *filesystem.ChunkItem
-	chunks       []*filesystem.ChunkItem
-	fileSize     int64
+	name      string
+	cf        *filesystem.ChunkFile
+	committed bool // whether the file has been stored in the database
+}
+
+// virtualHandle is a file opened on a virtualInode
+type virtualHandle struct {
+	inode     *virtualInode
+	readAhead filesystem.ReadAhead
+	owners    lockOwners
 }
 
 var (
@@ -34,140 +37,191 @@ var (
 	_ = (fs.NodeReader)((*virtualInode)(nil))
 	_ = (fs.NodeOpener)((*virtualInode)(nil))
 	_ = (fs.NodeFlusher)((*virtualInode)(nil))
+	_ = (fs.NodeFsyncer)((*virtualInode)(nil))
+	_ = (fs.NodeReleaser)((*virtualInode)(nil))
+	_ = (fs.NodeSetattrer)((*virtualInode)(nil))
+	_ = (fs.NodeGetxattrer)((*virtualInode)(nil))
+	_ = (fs.NodeSetxattrer)((*virtualInode)(nil))
+	_ = (fs.NodeListxattrer)((*virtualInode)(nil))
+	_ = (fs.NodeRemovexattrer)((*virtualInode)(nil))
+	_ = (fs.NodeGetlker)((*virtualInode)(nil))
+	_ = (fs.NodeSetlker)((*virtualInode)(nil))
+	_ = (fs.NodeSetlkwer)((*virtualInode)(nil))
 )
 
 func (bi *virtualInode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	if off >= int64(len(bi.data)) {
+	if off >= int64(bi.cf.OriginalSize) {
 		return fuse.ReadResultData(nil), 0
 	}
-	end := min(int(off)+len(dest), len(bi.data))
-	return fuse.ReadResultData(bi.data[off:end]), 0
+	end := min(off+int64(len(dest)), int64(bi.cf.OriginalSize))
+	ahead := configs.READ_AHEAD_CHUNKS
+	if h, ok := fh.(*virtualHandle); ok {
+		ahead = h.readAhead.Window(bi.cf, off, end)
+	}
+	if err := bi.cf.FetchRange(off, end, ahead); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to fetch %s at %d: %s", bi.name, off, err.Error()))
+		return nil, errnoOf(err)
+	}
+	data, err := bi.cf.GetBytes(off, end)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to read %s at %d: %s", bi.name, off, err.Error()))
+		return nil, errnoOf(err)
+	}
+	return fuse.ReadResultData(data), 0
 }
 
 func (bi *virtualInode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
-	if bi.data == nil {
-		bi.data = make([]byte, 0, configs.CHUNK_SIZE*2)
-		bi.currentChunk = &filesystem.ChunkItem{
-			Idx:         0,
-			Buf:         new(bytes.Buffer),
-			Name:        uuid.NewString(),
-			FileState:   filesystem.MEMORY,
-			ChunkFileId: bi.cf.Id,
-		}
-		bi.chunks = append(bi.chunks, bi.currentChunk)
+	// writers wait for the uploads holding memory to complete
+	if err := filesystem.WaitForMemory(ctx); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to write %s at %d: %s", bi.name, off, err.Error()))
+		return 0, errnoOf(err)
 	}
-
-	bytesWritten := uint32(0)
-	remainingData := data
-	currentOffset := off
-
-	for len(remainingData) > 0 {
-		spaceInCurrentChunk := configs.CHUNK_SIZE - bi.currentChunk.Buf.Len()
-		// chunk pieno
-		if spaceInCurrentChunk <= 0 {
-			bi.currentChunk.Size = bi.currentChunk.Buf.Len()
-			newChunkIdx := bi.currentChunk.Idx + 1
-			retryCount := 0
-			for {
-				if retryCount > 3 {
-					panic(fmt.Sprintf("Failed to upload chunk [%d] three times in a row", bi.currentChunk.Idx))
-				}
-				if err := bi.currentChunk.Send(); err != nil {
-					if tooManyRequests, ok := err.(*telegram.TooManyRequestsError); ok {
-						logger.LogWarn(fmt.Sprintf("Blocked because of too many requests. Retrying in %d seconds", tooManyRequests.Timeout))
-						time.Sleep(time.Duration(tooManyRequests.Timeout) * time.Second)
-					} else {
-						logger.LogWarn(fmt.Sprintf("Failed to send chunk [%d] -> %s", bi.currentChunk.Idx, err.Error()))
-						time.Sleep(2 * time.Second)
-					}
-					retryCount++
-				} else {
-					break
-				}
-			}
-			logger.LogInfo(fmt.Sprintf("Modified status of chunk [%d] -> %s - %s", bi.currentChunk.Idx, bi.currentChunk.FileState, *bi.currentChunk.FileId))
-			bi.currentChunk = &filesystem.ChunkItem{
-				Idx:         newChunkIdx,
-				Buf:         new(bytes.Buffer),
-				Name:        uuid.NewString(),
-				FileState:   filesystem.MEMORY,
-				ChunkFileId: bi.cf.Id,
-			}
-			bi.chunks = append(bi.chunks, bi.currentChunk)
-			spaceInCurrentChunk = configs.CHUNK_SIZE
-		}
-
-		// quanti dati posso copiare ancora nel chunk
-		writeLen := min(len(remainingData), spaceInCurrentChunk)
-
-		// copio i nuovi dati all'interno del chunk
-		n, err := bi.currentChunk.Buf.Write(remainingData[:writeLen])
-		if err != nil {
-			logger.LogErr(fmt.Sprintf("Errore durante la scrittura nel buffer del chunk: %v", err))
-			return bytesWritten, syscall.EIO // O un altro errore appropriato
-		}
-
-		bytesWritten += uint32(n)
-		remainingData = remainingData[n:]
-		currentOffset += int64(n)
-		bi.fileSize += int64(n)
+	n, err := bi.cf.WriteAt(data, off)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to write %s at %d: %s", bi.name, off, err.Error()))
+		return uint32(n), errnoOf(err)
 	}
+	bi.cf.UploadFullChunks(off + int64(n))
 
-	return bytesWritten, 0
+	return uint32(n), 0
 }
 
 func (bi *virtualInode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	out.Size = uint64(len(bi.data))
-	out.Mode = bi.mode
+	out.Size = uint64(bi.cf.OriginalSize)
+	out.Nlink = uint32(bi.cf.Links())
+	fillAttr(&bi.cf.Attributes, &out.Attr)
 	return 0
 }
 
-func (bi *virtualInode) Open(ctx context.Context, openFlags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	logger.LogInfo(fmt.Sprintf("Opening data from %s", bi.name))
-	if fuseFlags&(syscall.O_RDWR|syscall.O_WRONLY) != 0 {
-		return nil, 0, syscall.EROFS
+func (bi *virtualInode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	changed := bi.cf.UpdateAttributes(func(attrs *filesystem.Attributes) bool {
+		return applySetattr(in, attrs)
+	})
+	if size, ok := in.GetSize(); ok {
+		if err := bi.cf.Truncate(int64(size)); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to truncate %s: %s", bi.name, err.Error()))
+			return errnoOf(err)
+		}
+		changed = true
 	}
-
-	return bi, fuse.FOPEN_DIRECT_IO, 0
+	// not committed files are stored as a whole on flush
+	if changed && bi.committed {
+		if errno := saveFile(bi.cf); errno != 0 {
+			return errno
+		}
+	}
+	return bi.Getattr(ctx, f, out)
 }
 
-func (bi *virtualInode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
-	// Invio l'ultimo chunk che manca
-	retryCount := 0
-	for {
-		if retryCount > 3 {
-			panic(fmt.Sprintf("Failed to upload chunk [%d] three times in a row", bi.currentChunk.Idx))
+func (bi *virtualInode) Open(ctx context.Context, openFlags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	logger.LogInfo(fmt.Sprintf("Opening data from %s", bi.name))
+	if openFlags&syscall.O_TRUNC != 0 {
+		if err := bi.cf.Truncate(0); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to truncate %s: %s", bi.name, err.Error()))
+			return nil, 0, errnoOf(err)
 		}
-		bi.currentChunk.Size = bi.currentChunk.Buf.Len()
-
-		if err := bi.currentChunk.Send(); err != nil {
-			if tooManyRequests, ok := err.(*telegram.TooManyRequestsError); ok {
-				logger.LogErr(fmt.Sprintf("Blocked because of too many requests. Retrying in %d seconds", tooManyRequests.Timeout))
-				time.Sleep(time.Duration(tooManyRequests.Timeout) * time.Second)
-			} else {
-				logger.LogErr(fmt.Sprintf("Failed to send chunk [%d] -> %s", bi.currentChunk.Idx, err.Error()))
-				time.Sleep(2 * time.Second)
+		// not committed files are stored as a whole on flush
+		if bi.committed {
+			if errno := saveFile(bi.cf); errno != 0 {
+				return nil, 0, errno
 			}
-			retryCount++
-		} else {
-			break
 		}
 	}
+	return &virtualHandle{inode: bi}, fuse.FOPEN_DIRECT_IO, 0
+}
+
+// Flush is called on every close of the file, releasing the fcntl locks set
+// through it before storing the changes
+func (bi *virtualInode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	releaseLocks(ctx, bi.cf, f, false)
+	return bi.Fsync(ctx, f, 0)
+}
 
-	for idx := range bi.chunks {
-		chunk := bi.chunks[idx]
-		logger.LogInfo(fmt.Sprintf("Chunk: [%d] State: [%s] Id: [%p]", chunk.Idx, chunk.FileState, chunk.FileId))
-		bi.cf.Chunks = append(bi.cf.Chunks, chunk)
+func (bi *virtualInode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
+	if bi.committed && !bi.cf.HasChanges() {
+		return 0
 	}
-	bi.cf.NumChunks = len(bi.chunks)
-	bi.cf.OriginalSize = int(bi.fileSize)
 
 	logger.LogInfo(fmt.Sprintf("Flushing data from %s", bi.name))
+	if errno := saveFile(bi.cf); errno != 0 {
+		return errno
+	}
+	bi.committed = true
+
+	return 0
+}
+
+func (bi *virtualInode) Release(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	releaseLocks(ctx, bi.cf, f, true)
+	return 0
+}
 
-	if err := db.Connect(configs.DB_CONFIG).UploadFile(bi.cf); err != nil {
+// saveFile uploads the dirty chunks of the file and stores the changes
+func saveFile(cf *filesystem.ChunkFile) syscall.Errno {
+	err := cf.Save(func(changed []*filesystem.ChunkItem) error {
+		for idx := range changed {
+			chunk := changed[idx]
+			logger.LogInfo(fmt.Sprintf("Chunk: [%d] State: [%s] Id: [%p]", chunk.Idx, chunk.FileState, chunk.FileId))
+		}
+		return db.Connect(configs.DB_CONFIG).UpdateChunks(cf, changed)
+	})
+	if err != nil {
 		logger.LogErr(fmt.Sprintf("Failed to upload to database %s", err.Error()))
+		return errnoOf(err)
+	}
+	return 0
+}
+
+// errnoOf maps the failure of a transfer to the error returned to the caller.
+// Rate limiting that outlasted the retries can be retried later by the caller,
+// documents refused for their size and a full disk mean that there's no space.
+// Encrypted files can't be accessed without the master key. Requests waiting
+// for memory fail when it's not released in time or when they are interrupted
+func errnoOf(err error) syscall.Errno {
+	var tooManyRequests *telegram.TooManyRequestsError
+	var apiErr *telegram.APIError
+	switch {
+	case errors.As(err, &tooManyRequests):
+		return syscall.EAGAIN
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusRequestEntityTooLarge:
+		return syscall.ENOSPC
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return syscall.ENOSPC
+	case errors.Is(err, encryption.ErrNoMasterKey):
+		return syscall.EACCES
+	case errors.Is(err, syscall.ENOMEM):
+		return syscall.ENOMEM
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	default:
 		return syscall.EIO
 	}
+}
 
-	return 0
+func (bi *virtualInode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(bi.cf, attr, dest)
+}
+
+func (bi *virtualInode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(bi.cf, dest)
+}
+
+func (bi *virtualInode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setxattr(bi.cf, attr, data, flags, bi.committed)
+}
+
+func (bi *virtualInode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return removexattr(bi.cf, attr, bi.committed)
+}
+
+func (bi *virtualInode) Getlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	return getlk(bi.cf, owner, lk, out)
+}
+
+func (bi *virtualInode) Setlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return setlk(ctx, bi.cf, f, owner, lk, flags, false)
+}
+
+func (bi *virtualInode) Setlkw(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return setlk(ctx, bi.cf, f, owner, lk, flags, true)
 }
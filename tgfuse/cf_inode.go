@@ -3,7 +3,6 @@ package tgfuse
 import (
 	"context"
 	"fmt"
-	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -21,13 +20,13 @@ type CfInode struct {
 	lastRead      time.Time
 	currentlyRead bool
 	writeTmpFile  sync.Once
-
-	cancel *context.CancelCauseFunc
 }
 
 type CfHandle struct {
 	fs.FileHandle
-	inode *CfInode
+	inode     *CfInode
+	readAhead filesystem.ReadAhead
+	owners    lockOwners
 }
 
 // ---------------------
@@ -39,6 +38,18 @@ var (
 	_ = (fs.NodeReader)((*CfInode)(nil))
 	_ = (fs.NodeGetattrer)((*CfInode)(nil))
 	_ = (fs.NodeReleaser)((*CfInode)(nil))
+	_ = (fs.NodeWriter)((*CfInode)(nil))
+	_ = (fs.NodeFlusher)((*CfInode)(nil))
+	_ = (fs.NodeFsyncer)((*CfInode)(nil))
+	_ = (fs.NodeSetattrer)((*CfInode)(nil))
+	_ = (fs.NodeGetxattrer)((*CfInode)(nil))
+	_ = (fs.NodeSetxattrer)((*CfInode)(nil))
+	_ = (fs.NodeListxattrer)((*CfInode)(nil))
+	_ = (fs.NodeRemovexattrer)((*CfInode)(nil))
+	_ = (fs.NodeGetlker)((*CfInode)(nil))
+	_ = (fs.NodeSetlker)((*CfInode)(nil))
+	_ = (fs.NodeSetlkwer)((*CfInode)(nil))
+	_ = (fs.NodeReadlinker)((*CfInode)(nil))
 )
 
 var (
@@ -64,7 +75,11 @@ func (cf *CfInode) ClearBuffers() {
 
 func (cf *CfInode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	out.Size = uint64(cf.File.OriginalSize)
-	out.Mode = 0o444
+	if cf.File.IsSymlink() {
+		out.Size = uint64(len(cf.File.SymlinkTarget))
+	}
+	out.Nlink = uint32(cf.File.Links())
+	fillAttr(&cf.File.Attributes, &out.Attr)
 	return 0
 }
 
@@ -81,44 +96,142 @@ func (cf *CfInode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 
 func (cf *CfInode) Release(ctx context.Context, f fs.FileHandle) syscall.Errno {
 	logger.LogInfo(fmt.Sprintf("File '%s' has been released", cf.File.OriginalFilename))
-	if cf.cancel != nil {
-		(*cf.cancel)(fmt.Errorf("file released"))
-		cf.cancel = nil
-		logger.LogInfo(fmt.Sprintf("Removed from CfInode %p canceContext -> %p", cf, cf.cancel))
-	}
+	releaseLocks(ctx, cf.File, f, true)
 	return 0
 }
 
+func (cf *CfInode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if !cf.File.IsSymlink() {
+		return nil, syscall.EINVAL
+	}
+	return []byte(cf.File.SymlinkTarget), 0
+}
+
 func (cf *CfInode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	cf.File.WaitForReadable()
-	logger.LogInfo(fmt.Sprintf("CfInode %p has cancel -> %p", cf, cf.cancel))
-	if cf.cancel == nil {
-		ctx, cancel := context.WithCancelCause(context.Background())
-		cf.cancel = &cancel
-		cf.File.StartDownload(ctx)
-		logger.LogInfo(fmt.Sprintf("Started download for file %s", cf.File.OriginalFilename))
+	if off >= int64(cf.File.OriginalSize) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := min(off+int64(len(dest)), int64(cf.File.OriginalSize))
+	ahead := configs.READ_AHEAD_CHUNKS
+	if h, ok := fh.(*CfHandle); ok {
+		ahead = h.readAhead.Window(cf.File, off, end)
+	}
+	if err := cf.File.FetchRange(off, end, ahead); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to fetch %s at %d: %s", cf.File.OriginalFilename, off, err.Error()))
+		return nil, errnoOf(err)
 	}
 
 	logger.LogInfo(fmt.Sprintf("Reading content of file %s", cf.File.OriginalFilename))
+	cf.File.Accessed()
 	cf.lastRead = time.Now()
 	cf.currentlyRead = true
 	defer func() {
 		cf.currentlyRead = false
 	}()
 
-	end := min(off+int64(len(dest)), int64(cf.File.OriginalSize))
+	data, err := cf.File.GetBytes(off, end)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to read %s at %d: %s", cf.File.OriginalFilename, off, err.Error()))
+		return nil, errnoOf(err)
+	}
+	return fuse.ReadResultData(data), 0
+}
 
-	sort.Slice(cf.File.Chunks, func(i, j int) bool {
-		return cf.File.Chunks[i].Idx < cf.File.Chunks[j].Idx
+func (cf *CfInode) Open(ctx context.Context, openFlags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if openFlags&syscall.O_TRUNC != 0 {
+		if errno := cf.truncate(0); errno != 0 {
+			return nil, 0, errno
+		}
+	}
+	return &CfHandle{inode: cf}, 0, 0
+}
+
+func (cf *CfInode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	changed := cf.File.UpdateAttributes(func(attrs *filesystem.Attributes) bool {
+		return applySetattr(in, attrs)
 	})
+	if size, ok := in.GetSize(); ok {
+		if errno := cf.truncate(int64(size)); errno != 0 {
+			return errno
+		}
+	} else if changed {
+		if errno := saveFile(cf.File); errno != 0 {
+			return errno
+		}
+	}
+	return cf.Getattr(ctx, fh, out)
+}
+
+func (cf *CfInode) truncate(size int64) syscall.Errno {
+	cf.File.WaitForReadable()
+	logger.LogInfo(fmt.Sprintf("Truncating file %s to %d bytes", cf.File.OriginalFilename, size))
 
-	return fuse.ReadResultData(cf.File.GetBytes(off, end)), 0
+	if err := cf.File.Truncate(size); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to truncate %s: %s", cf.File.OriginalFilename, err.Error()))
+		return errnoOf(err)
+	}
+	return saveFile(cf.File)
 }
 
-func (cf *CfInode) Open(ctx context.Context, openFlags uint32) (fs.FileHandle, uint32, syscall.Errno) {
-	if openFlags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
-		return nil, 0, syscall.EROFS
+func (cf *CfInode) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	cf.File.WaitForReadable()
+	logger.LogInfo(fmt.Sprintf("Writing %d bytes to file %s at %d", len(data), cf.File.OriginalFilename, off))
+
+	// writers wait for the uploads holding memory to complete
+	if err := filesystem.WaitForMemory(ctx); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to write %s at %d: %s", cf.File.OriginalFilename, off, err.Error()))
+		return 0, errnoOf(err)
+	}
+	n, err := cf.File.WriteAt(data, off)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to write %s at %d: %s", cf.File.OriginalFilename, off, err.Error()))
+		return uint32(n), errnoOf(err)
 	}
+	cf.File.UploadFullChunks(off + int64(n))
 
-	return &CfHandle{inode: cf}, 0, 0
+	return uint32(n), 0
+}
+
+// Flush is called on every close of the file, releasing the fcntl locks set
+// through it before storing the changes
+func (cf *CfInode) Flush(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	releaseLocks(ctx, cf.File, fh, false)
+	return cf.Fsync(ctx, fh, 0)
+}
+
+func (cf *CfInode) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
+	if !cf.File.HasChanges() {
+		return 0
+	}
+	logger.LogInfo(fmt.Sprintf("Flushing changes of %s", cf.File.OriginalFilename))
+	return saveFile(cf.File)
+}
+
+func (cf *CfInode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(cf.File, attr, dest)
+}
+
+func (cf *CfInode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(cf.File, dest)
+}
+
+func (cf *CfInode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setxattr(cf.File, attr, data, flags, true)
+}
+
+func (cf *CfInode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return removexattr(cf.File, attr, true)
+}
+
+func (cf *CfInode) Getlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	return getlk(cf.File, owner, lk, out)
+}
+
+func (cf *CfInode) Setlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return setlk(ctx, cf.File, f, owner, lk, flags, false)
+}
+
+func (cf *CfInode) Setlkw(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return setlk(ctx, cf.File, f, owner, lk, flags, true)
 }
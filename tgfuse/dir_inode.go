@@ -0,0 +1,435 @@
+package tgfuse
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"it.smaso/tgfuse/configs"
+	db "it.smaso/tgfuse/database"
+	"it.smaso/tgfuse/filesystem"
+	"it.smaso/tgfuse/logger"
+)
+
+// STATFS_BLOCK_SIZE is the block size reported to statfs, sizes are rounded
+// down to it
+const STATFS_BLOCK_SIZE = 4096
+
+// DirInode is a folder of the mounted tree. The RootNode is a DirInode too, so
+// every operation defined here is available on the mount point as well
+type DirInode struct {
+	fs.Inode
+	Dir  *filesystem.Directory
+	root *RootNode
+}
+
+var (
+	_ = (fs.NodeCreater)((*DirInode)(nil))
+	_ = (fs.NodeMkdirer)((*DirInode)(nil))
+	_ = (fs.NodeRmdirer)((*DirInode)(nil))
+	_ = (fs.NodeUnlinker)((*DirInode)(nil))
+	_ = (fs.NodeRenamer)((*DirInode)(nil))
+	_ = (fs.NodeReaddirer)((*DirInode)(nil))
+	_ = (fs.NodeGetattrer)((*DirInode)(nil))
+	_ = (fs.NodeSetattrer)((*DirInode)(nil))
+	_ = (fs.NodeLookuper)((*DirInode)(nil))
+	_ = (fs.NodeSymlinker)((*DirInode)(nil))
+	_ = (fs.NodeLinker)((*DirInode)(nil))
+	_ = (fs.NodeStatfser)((*DirInode)(nil))
+	_ = (fs.NodeGetxattrer)((*DirInode)(nil))
+	_ = (fs.NodeSetxattrer)((*DirInode)(nil))
+	_ = (fs.NodeListxattrer)((*DirInode)(nil))
+	_ = (fs.NodeRemovexattrer)((*DirInode)(nil))
+)
+
+func (d *DirInode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR
+	fillAttr(&d.Dir.Attributes, &out.Attr)
+	return 0
+}
+
+func (d *DirInode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	d.root.lock()
+	defer d.root.unlock()
+
+	old := d.Dir.Attributes
+	if applySetattr(in, &d.Dir.Attributes) {
+		d.Dir.Changed()
+		// the mount point isn't stored, its attributes last until unmount
+		if !d.Dir.IsRoot() {
+			if err := db.Connect(configs.DB_CONFIG).UploadDirectory(d.Dir); err != nil {
+				logger.LogErr(fmt.Sprintf("Failed to update directory %s: %s", d.Dir.Name, err.Error()))
+				d.Dir.Attributes = old
+				return syscall.EIO
+			}
+		}
+	}
+	return d.Getattr(ctx, f, out)
+}
+
+func (d *DirInode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	used, files := d.root.usage()
+
+	capacity := uint64(configs.VIRTUAL_CAPACITY)
+	free := capacity - min(used, capacity)
+	out.Bsize = STATFS_BLOCK_SIZE
+	out.Frsize = STATFS_BLOCK_SIZE
+	out.Blocks = capacity / STATFS_BLOCK_SIZE
+	out.Bfree = free / STATFS_BLOCK_SIZE
+	out.Bavail = out.Bfree
+
+	out.Files = max(uint64(configs.VIRTUAL_FILES), files)
+	out.Ffree = out.Files - files
+	out.NameLen = 255
+	return 0
+}
+
+func (d *DirInode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries := []fuse.DirEntry{
+		{
+			Name: ".",
+			Mode: fuse.S_IFDIR,
+		},
+		{
+			Name: "..",
+			Mode: fuse.S_IFDIR,
+		},
+	}
+
+	for name, node := range d.Children() {
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Mode: node.Mode(),
+		})
+	}
+
+	return fs.NewListDirStream(entries), 0
+}
+
+func (d *DirInode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	logger.LogInfo(fmt.Sprintf("Looking up for file %s", name))
+	node := d.GetChild(name)
+	if node == nil {
+		return nil, syscall.ENOENT
+	}
+
+	out.SetEntryTimeout(20 * time.Second)
+	out.SetAttrTimeout(10 * time.Second)
+
+	if getattrer, ok := node.Operations().(fs.NodeGetattrer); ok {
+		attrOut := fuse.AttrOut{}
+		if errno := getattrer.Getattr(ctx, nil, &attrOut); errno == 0 {
+			out.Attr = attrOut.Attr
+		}
+	}
+	attr := node.StableAttr()
+	out.Attr.Mode = (out.Attr.Mode & 0o7777) | attr.Mode
+	out.Attr.Ino = attr.Ino
+
+	return node, 0
+}
+
+func (d *DirInode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	logger.LogInfo(fmt.Sprintf("Creating File %s", name))
+
+	bInode := virtualInode{
+		name: name,
+		cf: &filesystem.ChunkFile{
+			OriginalFilename: name,
+			ParentId:         d.Dir.Id,
+			Id:               uuid.NewString(),
+			Attributes:       newAttributes(ctx, mode),
+		},
+	}
+
+	ch := d.NewInode(
+		ctx,
+		&bInode,
+		fs.StableAttr{Mode: mode},
+	)
+	d.AddChild(name, ch, false)
+
+	d.root.mu.Lock()
+	d.root.virtualNodes[bInode.cf.Id] = &bInode
+	d.root.mu.Unlock()
+
+	return ch, &virtualHandle{inode: &bInode}, 0, 0
+}
+
+func (d *DirInode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	logger.LogInfo(fmt.Sprintf("Creating directory %s", name))
+	if d.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+
+	d.root.lock()
+	defer d.root.unlock()
+
+	dir := filesystem.NewDirectory(name, d.Dir.Id, newAttributes(ctx, mode))
+	if err := db.Connect(configs.DB_CONFIG).UploadDirectory(dir); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to upload directory %s: %s", name, err.Error()))
+		return nil, syscall.EIO
+	}
+
+	dInode := &DirInode{Dir: dir, root: d.root}
+	ch := d.NewInode(
+		ctx,
+		dInode,
+		fs.StableAttr{Mode: syscall.S_IFDIR},
+	)
+	d.root.Dirs[dir.Id] = dInode
+
+	out.Mode = fuse.S_IFDIR
+	fillAttr(&dir.Attributes, &out.Attr)
+	return ch, 0
+}
+
+func (d *DirInode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	logger.LogInfo(fmt.Sprintf("Removing directory %s", name))
+	node := d.GetChild(name)
+	if node == nil {
+		return syscall.ENOENT
+	}
+	dInode, ok := node.Operations().(*DirInode)
+	if !ok {
+		return syscall.ENOTDIR
+	}
+	if len(node.Children()) > 0 {
+		return syscall.ENOTEMPTY
+	}
+
+	d.root.lock()
+	defer d.root.unlock()
+
+	if err := db.Connect(configs.DB_CONFIG).DeleteDirectory(dInode.Dir); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to delete directory %s: %s", name, err.Error()))
+		return syscall.EIO
+	}
+	delete(d.root.Dirs, dInode.Dir.Id)
+	forgetPin(dInode.Dir.Id)
+
+	return 0
+}
+
+func (d *DirInode) Unlink(ctx context.Context, name string) syscall.Errno {
+	logger.LogInfo(fmt.Sprintf("Removing file %s", name))
+	node := d.GetChild(name)
+	if node == nil {
+		return syscall.ENOENT
+	}
+	if node.IsDir() {
+		return syscall.EISDIR
+	}
+	cf := fileOf(node)
+	if cf == nil {
+		return syscall.EPERM
+	}
+
+	d.root.lock()
+	defer d.root.unlock()
+
+	batch := db.Batch{}
+	unlink := d.root.stageUnlink(&batch, cf, d.Dir.Id, name)
+	unlink.apply()
+	if err := db.Connect(configs.DB_CONFIG).Commit(batch); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to delete file %s: %s", name, err.Error()))
+		unlink.revert()
+		return syscall.EIO
+	}
+	unlink.done()
+
+	return 0
+}
+
+func (d *DirInode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	logger.LogInfo(fmt.Sprintf("Creating symlink %s to %s", name, target))
+	if d.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+
+	d.root.lock()
+	defer d.root.unlock()
+
+	cf := &filesystem.ChunkFile{
+		OriginalFilename: name,
+		ParentId:         d.Dir.Id,
+		Id:               uuid.NewString(),
+		SymlinkTarget:    target,
+		Attributes:       newAttributes(ctx, 0o777),
+	}
+
+	if err := db.Connect(configs.DB_CONFIG).UploadFile(cf); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to upload symlink %s: %s", name, err.Error()))
+		return nil, syscall.EIO
+	}
+
+	inode := &CfInode{File: cf}
+	ch := d.NewInode(
+		ctx,
+		inode,
+		fs.StableAttr{Mode: syscall.S_IFLNK},
+	)
+	d.root.Nodes[cf.Id] = inode
+
+	attrOut := fuse.AttrOut{}
+	inode.Getattr(ctx, nil, &attrOut)
+	out.Attr = attrOut.Attr
+	out.Mode = fuse.S_IFLNK | cf.Mode
+	return ch, 0
+}
+
+func (d *DirInode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	logger.LogInfo(fmt.Sprintf("Creating hard link %s", name))
+	if d.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+
+	node := target.EmbeddedInode()
+	if node.IsDir() {
+		return nil, syscall.EPERM
+	}
+	cf := fileOf(node)
+	if cf == nil {
+		return nil, syscall.EPERM
+	}
+	// the link refers to the stored file, so a new file is saved right away
+	if bi, ok := target.(*virtualInode); ok && !bi.committed {
+		if errno := bi.Fsync(ctx, nil, 0); errno != 0 {
+			return nil, errno
+		}
+	}
+
+	d.root.lock()
+	defer d.root.unlock()
+
+	link := filesystem.NewLink(cf.Id, d.Dir.Id, name)
+	oldNlink, oldCtime := cf.Nlink, cf.Ctime
+	cf.SetLinks(cf.Links()+1, nil)
+
+	batch := db.Batch{Files: []*filesystem.ChunkFile{cf}, Links: []*filesystem.Link{link}}
+	if err := db.Connect(configs.DB_CONFIG).Commit(batch); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to create hard link %s: %s", name, err.Error()))
+		cf.SetLinks(oldNlink, &oldCtime)
+		return nil, syscall.EIO
+	}
+	d.root.links[link.Id] = link
+
+	if getattrer, ok := target.(fs.NodeGetattrer); ok {
+		attrOut := fuse.AttrOut{}
+		getattrer.Getattr(ctx, nil, &attrOut)
+		out.Attr = attrOut.Attr
+	}
+	return node, 0
+}
+
+func (d *DirInode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	logger.LogInfo(fmt.Sprintf("Renaming %s to %s", name, newName))
+	target := asDirInode(newParent)
+	if target == nil {
+		return syscall.ENOTDIR
+	}
+	source := d.GetChild(name)
+	if source == nil {
+		return syscall.ENOENT
+	}
+	replaced := target.GetChild(newName)
+	if replaced == source {
+		return 0
+	}
+
+	exchange := flags&fs.RENAME_EXCHANGE != 0
+	if flags&RENAME_NOREPLACE != 0 && replaced != nil {
+		return syscall.EEXIST
+	}
+	if exchange && replaced == nil {
+		return syscall.ENOENT
+	}
+
+	d.root.lock()
+	defer d.root.unlock()
+
+	batch := db.Batch{}
+	changes := []stagedChange{}
+
+	move, errno := d.root.stageMove(&batch, source, d.Dir.Id, name, target.Dir.Id, newName)
+	if errno != 0 {
+		return errno
+	}
+	changes = append(changes, move)
+
+	if exchange {
+		move, errno := d.root.stageMove(&batch, replaced, target.Dir.Id, newName, d.Dir.Id, name)
+		if errno != 0 {
+			return errno
+		}
+		changes = append(changes, move)
+	} else if replaced != nil {
+		change, errno := d.root.stageReplace(&batch, source, replaced, target.Dir.Id, newName)
+		if errno != 0 {
+			return errno
+		}
+		changes = append(changes, change)
+	}
+
+	for _, change := range changes {
+		change.apply()
+	}
+	if err := db.Connect(configs.DB_CONFIG).Commit(batch); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to rename %s to %s: %s", name, newName, err.Error()))
+		for _, change := range slices.Backward(changes) {
+			change.revert()
+		}
+		return syscall.EIO
+	}
+	for _, change := range changes {
+		change.done()
+	}
+
+	return 0
+}
+
+// asDirInode returns the folder behind the given node, if it's a folder at all
+func asDirInode(node fs.InodeEmbedder) *DirInode {
+	switch dir := node.(type) {
+	case *DirInode:
+		return dir
+	case *RootNode:
+		return &dir.DirInode
+	}
+	return nil
+}
+
+// Folders only have the XATTR_PINNED attribute, pinning a folder pins every file
+// it contains, at any depth
+func (d *DirInode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if attr == XATTR_PINNED && filesystem.IsPinned(d.Dir.Id) {
+		return copyXattr([]byte("1"), dest)
+	}
+	return 0, syscall.Errno(fuse.ENOATTR)
+}
+
+func (d *DirInode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if filesystem.IsPinned(d.Dir.Id) {
+		return copyXattr([]byte(XATTR_PINNED+"\x00"), dest)
+	}
+	return copyXattr(nil, dest)
+}
+
+func (d *DirInode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if attr != XATTR_PINNED {
+		return syscall.ENOTSUP
+	}
+	return setPinned(d.Dir.Id, true, d.root.PrefetchPinned)
+}
+
+func (d *DirInode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if attr != XATTR_PINNED || !filesystem.IsPinned(d.Dir.Id) {
+		return syscall.Errno(fuse.ENOATTR)
+	}
+	return setPinned(d.Dir.Id, false, nil)
+}
@@ -0,0 +1,287 @@
+package tgfuse
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	db "it.smaso/tgfuse/database"
+	"it.smaso/tgfuse/filesystem"
+)
+
+// stagedChange is a change of the tree applied before being stored, so that it
+// can be reverted if the database rejects it
+type stagedChange interface {
+	apply()
+	revert()
+	// done completes the change once it has been stored
+	done()
+}
+
+// entryMove is a pending change of the name and parent of an entry of the tree
+type entryMove struct {
+	parentId    *string
+	name        *string
+	oldParentId string
+	oldName     string
+	newParentId string
+	newName     string
+	onApply     func(name string)
+}
+
+func (m *entryMove) apply() {
+	*m.parentId = m.newParentId
+	*m.name = m.newName
+	if m.onApply != nil {
+		m.onApply(m.newName)
+	}
+}
+
+func (m *entryMove) revert() {
+	*m.parentId = m.oldParentId
+	*m.name = m.oldName
+	if m.onApply != nil {
+		m.onApply(m.oldName)
+	}
+}
+
+func (m *entryMove) done() {}
+
+// entryUnlink is a pending removal of one of the names of a file. The file is
+// deleted together with its last name, otherwise the link is deleted instead.
+// When the removed name is the one stored in the file, a link takes its place
+type entryUnlink struct {
+	rn      *RootNode
+	cf      *filesystem.ChunkFile
+	link    *filesystem.Link // nil when the whole file is deleted
+	promote bool
+
+	oldParentId string
+	oldName     string
+	oldNlink    int
+	oldCtime    time.Time
+}
+
+func (u *entryUnlink) apply() {
+	if u.link == nil {
+		return
+	}
+	delete(u.rn.links, u.link.Id)
+	if u.promote {
+		u.cf.ParentId = u.link.ParentId
+		u.cf.OriginalFilename = u.link.Name
+	}
+	u.cf.SetLinks(len(u.rn.linksOf(u.cf.Id))+1, nil)
+}
+
+func (u *entryUnlink) revert() {
+	if u.link == nil {
+		return
+	}
+	u.rn.links[u.link.Id] = u.link
+	u.cf.ParentId = u.oldParentId
+	u.cf.OriginalFilename = u.oldName
+	u.cf.SetLinks(u.oldNlink, &u.oldCtime)
+}
+
+func (u *entryUnlink) done() {
+	if u.link == nil {
+		u.rn.forgetFile(u.cf)
+	}
+}
+
+// entryRmdir is a pending removal of an empty folder
+type entryRmdir struct {
+	rn  *RootNode
+	dir *filesystem.Directory
+}
+
+func (r *entryRmdir) apply()  {}
+func (r *entryRmdir) revert() {}
+
+func (r *entryRmdir) done() {
+	delete(r.rn.Dirs, r.dir.Id)
+	forgetPin(r.dir.Id)
+}
+
+// fileOf returns the ChunkFile behind the node, if the node is a file
+func fileOf(node *fs.Inode) *filesystem.ChunkFile {
+	switch inode := node.Operations().(type) {
+	case *CfInode:
+		return inode.File
+	case *virtualInode:
+		return inode.cf
+	}
+	return nil
+}
+
+// stageMove prepares the move of node from the name oldName in oldParentId to
+// the given folder and name, adding the entry to the batch of changes to be
+// stored. If the old name is a hard link, only the link is moved
+func (rn *RootNode) stageMove(batch *db.Batch, node *fs.Inode, oldParentId, oldName, parentId, name string) (*entryMove, syscall.Errno) {
+	move := &entryMove{newParentId: parentId, newName: name}
+
+	if cf := fileOf(node); cf != nil {
+		if link := rn.linkAt(cf.Id, oldParentId, oldName); link != nil {
+			move.parentId = &link.ParentId
+			move.name = &link.Name
+			move.oldParentId = link.ParentId
+			move.oldName = link.Name
+			batch.Links = append(batch.Links, link)
+			return move, 0
+		}
+	}
+
+	switch inode := node.Operations().(type) {
+	case *DirInode:
+		if rn.isDescendant(parentId, inode.Dir.Id) {
+			return nil, syscall.EINVAL
+		}
+		move.parentId = &inode.Dir.ParentId
+		move.name = &inode.Dir.Name
+		batch.Directories = append(batch.Directories, inode.Dir)
+	case *CfInode:
+		move.parentId = &inode.File.ParentId
+		move.name = &inode.File.OriginalFilename
+		move.onApply = func(string) { inode.File.Moved() }
+		batch.Files = append(batch.Files, inode.File)
+	case *virtualInode:
+		move.parentId = &inode.cf.ParentId
+		move.name = &inode.cf.OriginalFilename
+		move.onApply = func(name string) {
+			inode.name = name
+			inode.cf.Moved()
+		}
+		if inode.committed {
+			batch.Files = append(batch.Files, inode.cf)
+		}
+	default:
+		return nil, syscall.EPERM
+	}
+
+	move.oldParentId = *move.parentId
+	move.oldName = *move.name
+	return move, 0
+}
+
+// stageReplace adds to the batch the deletion of the entry named name in
+// parentId, overwritten by a rename, checking that source can take its place
+func (rn *RootNode) stageReplace(batch *db.Batch, source, replaced *fs.Inode, parentId, name string) (stagedChange, syscall.Errno) {
+	if replaced.IsDir() {
+		if !source.IsDir() {
+			return nil, syscall.EISDIR
+		}
+		if len(replaced.Children()) > 0 {
+			return nil, syscall.ENOTEMPTY
+		}
+		dir := replaced.Operations().(*DirInode).Dir
+		batch.DeletedDirectories = append(batch.DeletedDirectories, dir)
+		return &entryRmdir{rn: rn, dir: dir}, 0
+	}
+
+	if source.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	cf := fileOf(replaced)
+	if cf == nil {
+		return nil, syscall.EPERM
+	}
+	return rn.stageUnlink(batch, cf, parentId, name), 0
+}
+
+// stageUnlink prepares the removal of the name of the file in parentId
+func (rn *RootNode) stageUnlink(batch *db.Batch, cf *filesystem.ChunkFile, parentId, name string) *entryUnlink {
+	unlink := &entryUnlink{rn: rn, cf: cf}
+
+	links := rn.linksOf(cf.Id)
+	if len(links) == 0 {
+		batch.DeletedFiles = append(batch.DeletedFiles, cf)
+		return unlink
+	}
+
+	unlink.oldParentId = cf.ParentId
+	unlink.oldName = cf.OriginalFilename
+	unlink.oldNlink = cf.Nlink
+	unlink.oldCtime = cf.Ctime
+	unlink.link = rn.linkAt(cf.Id, parentId, name)
+	if unlink.link == nil {
+		unlink.link = links[0]
+		unlink.promote = true
+	}
+	batch.DeletedLinks = append(batch.DeletedLinks, unlink.link)
+	batch.Files = append(batch.Files, cf)
+	return unlink
+}
+
+// forgetFile drops a deleted file from the tree indexes together with its
+// local and remote data. Messages are kept when DELETE_REMOTE_MESSAGES is off
+func (rn *RootNode) forgetFile(cf *filesystem.ChunkFile) {
+	delete(rn.Nodes, cf.Id)
+	delete(rn.virtualNodes, cf.Id)
+
+	cf.DiscardChanges()
+	cf.DeleteTmpFile()
+	forgetPin(cf.Id)
+	go cf.DeleteRemoteChunks()
+}
+
+// newAttributes returns the attributes of an entry created by the caller of the
+// request, falling back to the user running the mount
+func newAttributes(ctx context.Context, mode uint32) filesystem.Attributes {
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	if caller, ok := fuse.FromContext(ctx); ok {
+		uid, gid = caller.Uid, caller.Gid
+	}
+	return filesystem.NewAttributes(mode, uid, gid)
+}
+
+// fillAttr copies the stored attributes to the ones returned to the kernel.
+// Entries stored before attributes were persisted have the defaults given when
+// loading them, and their timestamps keep the fuse defaults
+func fillAttr(attrs *filesystem.Attributes, out *fuse.Attr) {
+	out.Mode |= attrs.Mode
+	out.Uid = attrs.Uid
+	out.Gid = attrs.Gid
+
+	var atime, mtime, ctime *time.Time
+	if !attrs.Atime.IsZero() {
+		atime = &attrs.Atime
+	}
+	if !attrs.Mtime.IsZero() {
+		mtime = &attrs.Mtime
+	}
+	if !attrs.Ctime.IsZero() {
+		ctime = &attrs.Ctime
+	}
+	out.SetTimes(atime, mtime, ctime)
+}
+
+// applySetattr copies to attrs the changes requested by chmod, chown and
+// utimens, returning whether something changed
+func applySetattr(in *fuse.SetAttrIn, attrs *filesystem.Attributes) bool {
+	changed := false
+	if mode, ok := in.GetMode(); ok {
+		attrs.Mode = mode & 0o7777
+		changed = true
+	}
+	if uid, ok := in.GetUID(); ok {
+		attrs.Uid = uid
+		changed = true
+	}
+	if gid, ok := in.GetGID(); ok {
+		attrs.Gid = gid
+		changed = true
+	}
+	if atime, ok := in.GetATime(); ok {
+		attrs.Atime = atime
+		changed = true
+	}
+	if mtime, ok := in.GetMTime(); ok {
+		attrs.Mtime = mtime
+		changed = true
+	}
+	return changed
+}
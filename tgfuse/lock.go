@@ -0,0 +1,154 @@
+package tgfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"it.smaso/tgfuse/configs"
+	db "it.smaso/tgfuse/database"
+	"it.smaso/tgfuse/filesystem"
+	"it.smaso/tgfuse/logger"
+)
+
+// toFileLock converts a lock requested by the kernel. Both fcntl and flock
+// locks are identified by the owner the kernel gives them
+func toFileLock(owner uint64, lk *fuse.FileLock) filesystem.FileLock {
+	return filesystem.FileLock{
+		Owner: strconv.FormatUint(owner, 16),
+		Typ:   lk.Typ,
+		Start: lk.Start,
+		End:   lk.End,
+		Pid:   lk.Pid,
+	}
+}
+
+func getlk(cf *filesystem.ChunkFile, owner uint64, lk *fuse.FileLock, out *fuse.FileLock) syscall.Errno {
+	held, err := db.Connect(configs.DB_CONFIG).GetLock(cf, toFileLock(owner, lk))
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to read locks of %s: %s", cf.OriginalFilename, err.Error()))
+		return syscall.ENOLCK
+	}
+	if held == nil {
+		*out = *lk
+		out.Typ = syscall.F_UNLCK
+		return 0
+	}
+	*out = fuse.FileLock{
+		Start: held.Start,
+		End:   held.End,
+		Typ:   held.Typ,
+		Pid:   held.Pid,
+	}
+	return 0
+}
+
+// lockSetter acquires and releases the locks of the files, see db.DatabaseConnection
+type lockSetter interface {
+	SetLock(ctx context.Context, cf *filesystem.ChunkFile, lk filesystem.FileLock, wait bool) error
+}
+
+// lockOwners are the owners of the locks set through an open file. Closing the
+// file releases the fcntl locks of its owners, while flock locks belong to the
+// open file itself and are released once it is released
+type lockOwners struct {
+	mu    sync.Mutex
+	posix map[uint64]bool
+	flock map[uint64]bool
+}
+
+func (o *lockOwners) add(owner uint64, flags uint32) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		if o.flock == nil {
+			o.flock = map[uint64]bool{}
+		}
+		o.flock[owner] = true
+		return
+	}
+	if o.posix == nil {
+		o.posix = map[uint64]bool{}
+	}
+	o.posix[owner] = true
+}
+
+// take returns the owners whose locks must be released, forgetting them. The
+// owners of flock locks are returned only when the file is released
+func (o *lockOwners) take(release bool) []uint64 {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	owners := []uint64{}
+	for owner := range o.posix {
+		owners = append(owners, owner)
+	}
+	o.posix = nil
+	if release {
+		for owner := range o.flock {
+			owners = append(owners, owner)
+		}
+		o.flock = nil
+	}
+	return owners
+}
+
+// ownersOf returns the lock owners of an open file, nil if it has none
+func ownersOf(fh fs.FileHandle) *lockOwners {
+	switch h := fh.(type) {
+	case *CfHandle:
+		return &h.owners
+	case *virtualHandle:
+		return &h.owners
+	}
+	return nil
+}
+
+// releaseLocks drops over the whole file the locks set through fh, like the
+// kernel does on close(2). release tells whether fh is being released
+func releaseLocks(ctx context.Context, cf *filesystem.ChunkFile, fh fs.FileHandle, release bool) {
+	unlockOwners(ctx, db.Connect(configs.DB_CONFIG), cf, ownersOf(fh).take(release))
+}
+
+func unlockOwners(ctx context.Context, locks lockSetter, cf *filesystem.ChunkFile, owners []uint64) {
+	for _, owner := range owners {
+		lk := fuse.FileLock{Typ: syscall.F_UNLCK, Start: 0, End: math.MaxUint64}
+		if err := locks.SetLock(ctx, cf, toFileLock(owner, &lk), false); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to release locks of %s: %s", cf.OriginalFilename, err.Error()))
+		}
+	}
+}
+
+func setlk(ctx context.Context, cf *filesystem.ChunkFile, fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, wait bool) syscall.Errno {
+	return setlkWith(ctx, db.Connect(configs.DB_CONFIG), cf, ownersOf(fh), owner, lk, flags, wait)
+}
+
+func setlkWith(ctx context.Context, locks lockSetter, cf *filesystem.ChunkFile, owners *lockOwners, owner uint64, lk *fuse.FileLock, flags uint32, wait bool) syscall.Errno {
+	err := locks.SetLock(ctx, cf, toFileLock(owner, lk), wait)
+	if err == nil && lk.Typ != syscall.F_UNLCK {
+		owners.add(owner, flags)
+	}
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, db.ErrLocked):
+		return syscall.EAGAIN
+	case ctx.Err() != nil:
+		return syscall.EINTR
+	}
+	logger.LogErr(fmt.Sprintf("Failed to lock %s: %s", cf.OriginalFilename, err.Error()))
+	return syscall.ENOLCK
+}
@@ -0,0 +1,65 @@
+package tgfuse
+
+import (
+	"context"
+	"math"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	db "it.smaso/tgfuse/database"
+	"it.smaso/tgfuse/filesystem"
+)
+
+// memoryLocks keeps the locks of a single file in memory, the same way the
+// database does
+type memoryLocks struct {
+	held map[string][]filesystem.FileLock
+}
+
+func (m *memoryLocks) SetLock(ctx context.Context, cf *filesystem.ChunkFile, lk filesystem.FileLock, wait bool) error {
+	for owner, locks := range m.held {
+		for _, held := range locks {
+			if owner != lk.Owner && lk.Typ != syscall.F_UNLCK && lk.Conflicts(&held) {
+				return db.ErrLocked
+			}
+		}
+	}
+	m.held[lk.Owner] = filesystem.ApplyLock(m.held[lk.Owner], lk)
+	return nil
+}
+
+func TestCloseReleasesLocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   uint32
+		release bool
+		want    syscall.Errno
+	}{
+		{name: "fcntl lock on flush", flags: 0, release: false, want: 0},
+		{name: "fcntl lock on release", flags: 0, release: true, want: 0},
+		{name: "flock lock on flush", flags: fuse.FUSE_LK_FLOCK, release: false, want: syscall.EAGAIN},
+		{name: "flock lock on release", flags: fuse.FUSE_LK_FLOCK, release: true, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			locks := &memoryLocks{held: map[string][]filesystem.FileLock{}}
+			cf := &filesystem.ChunkFile{Id: "file"}
+			handle := &CfHandle{}
+			lk := fuse.FileLock{Typ: syscall.F_WRLCK, Start: 0, End: math.MaxUint64}
+
+			if errno := setlkWith(ctx, locks, cf, &handle.owners, 1, &lk, tt.flags, false); errno != 0 {
+				t.Fatalf("first lock failed: %v", errno)
+			}
+			if errno := setlkWith(ctx, locks, cf, nil, 2, &lk, tt.flags, false); errno != syscall.EAGAIN {
+				t.Fatalf("lock of another owner = %v, want EAGAIN", errno)
+			}
+
+			unlockOwners(ctx, locks, cf, ownersOf(handle).take(tt.release))
+			if errno := setlkWith(ctx, locks, cf, nil, 2, &lk, tt.flags, false); errno != tt.want {
+				t.Errorf("lock after close = %v, want %v", errno, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package tgfuse
+
+import "golang.org/x/sys/unix"
+
+// RENAME_NOREPLACE is the flag argument of renamex_np() refusing to replace
+// the destination
+const RENAME_NOREPLACE = unix.RENAME_EXCL
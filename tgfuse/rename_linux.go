@@ -0,0 +1,7 @@
+package tgfuse
+
+import "golang.org/x/sys/unix"
+
+// RENAME_NOREPLACE is a flag argument for renameat2(), the fs package only
+// defines RENAME_EXCHANGE
+const RENAME_NOREPLACE = unix.RENAME_NOREPLACE
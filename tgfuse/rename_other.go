@@ -0,0 +1,6 @@
+//go:build !linux && !darwin
+
+package tgfuse
+
+// RENAME_NOREPLACE is not forwarded on this platform
+const RENAME_NOREPLACE = 0
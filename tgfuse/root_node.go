@@ -3,125 +3,456 @@ package tgfuse
 import (
 	"context"
 	"fmt"
+	"os"
+	"sync"
 	"syscall"
-	"time"
 
-	"github.com/google/uuid"
 	"github.com/hanwen/go-fuse/v2/fs"
-	"github.com/hanwen/go-fuse/v2/fuse"
 	"it.smaso/tgfuse/filesystem"
 	"it.smaso/tgfuse/logger"
 )
 
+// RootNode is the directory mounted by fuse. Other than being a directory on
+// its own, it keeps track of every file and folder of the tree by id
 type RootNode struct {
-	fs.Inode
+	DirInode
 	Nodes        map[string]*CfInode
+	Dirs         map[string]*DirInode
 	virtualNodes map[string]*virtualInode
-}
+	links        map[string]*filesystem.Link
+	mu           sync.RWMutex
 
-var (
-	_ = (fs.NodeCreater)((*RootNode)(nil))
-	_ = (fs.NodeReaddirer)((*RootNode)(nil))
-	_ = (fs.NodeGetattrer)((*RootNode)(nil))
-	_ = (fs.NodeLookuper)((*RootNode)(nil))
-)
+	// revision is increased on every change made from this mount, so that a
+	// Sync based on data read before the change can be discarded
+	revision uint64
+}
 
 func NewRoot() *RootNode {
-	return &RootNode{
+	rn := &RootNode{
 		virtualNodes: make(map[string]*virtualInode),
 		Nodes:        make(map[string]*CfInode),
+		Dirs:         make(map[string]*DirInode),
+		links:        make(map[string]*filesystem.Link),
 	}
+	rn.DirInode = DirInode{
+		Dir: &filesystem.Directory{
+			Id:         filesystem.ROOT_ID,
+			Attributes: filesystem.NewAttributes(0o755, uint32(os.Getuid()), uint32(os.Getgid())),
+		},
+		root: rn,
+	}
+	rn.Dirs[filesystem.ROOT_ID] = &rn.DirInode
+	filesystem.SetPinResolver(rn.isPinned)
+	return rn
+}
+
+// lock must be held while applying a local change both to the database and to
+// the tree
+func (rn *RootNode) lock() {
+	rn.mu.Lock()
+	rn.revision++
 }
 
-func (rn *RootNode) GetCurrentNames() []string {
-	names := []string{}
-	for idx := range rn.Nodes {
-		names = append(names, rn.Nodes[idx].File.OriginalFilename)
+func (rn *RootNode) unlock() {
+	rn.mu.Unlock()
+}
+
+func (rn *RootNode) Revision() uint64 {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+	return rn.revision
+}
+
+// GetFiles returns the files currently in the tree
+func (rn *RootNode) GetFiles() []*CfInode {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	nodes := []*CfInode{}
+	for _, node := range rn.Nodes {
+		nodes = append(nodes, node)
 	}
-	return names
+	return nodes
 }
 
-func (rn *RootNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	out.Mode = fuse.S_IFDIR | 0o755
-	out.Mtime = uint64(time.Now().UnixMilli())
-	out.Atime = uint64(time.Now().UnixMilli())
-	return 0
+// PrefetchPinned downloads the chunks of the pinned files that are not cached,
+// including the files in pinned directories
+func (rn *RootNode) PrefetchPinned() {
+	for _, node := range rn.GetFiles() {
+		if rn.isPinned(node.File) {
+			prefetchFile(node.File)
+		}
+	}
 }
 
-func (rn *RootNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	entries := []fuse.DirEntry{
-		{
-			Name: ".",
-			Mode: fuse.S_IFDIR,
-		},
-		{
-			Name: "..",
-			Mode: fuse.S_IFDIR,
-		},
+// isPinned tells whether the file, or a directory containing any of its names,
+// is pinned
+func (rn *RootNode) isPinned(cf *filesystem.ChunkFile) bool {
+	if filesystem.IsPinned(cf.Id) {
+		return true
+	}
+
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	parents := []string{cf.ParentId}
+	for _, link := range rn.linksOf(cf.Id) {
+		parents = append(parents, link.ParentId)
 	}
+	for _, parentId := range parents {
+		// the depth is bounded in case a concurrent sync left a cycle
+		id := parentId
+		for range len(rn.Dirs) {
+			if filesystem.IsPinned(id) {
+				return true
+			}
+			node, found := rn.Dirs[id]
+			if !found || id == filesystem.ROOT_ID {
+				break
+			}
+			id = node.Dir.ParentId
+		}
+	}
+	return false
+}
+
+// usage returns the bytes stored in the mount and the number of files, counting
+// the ones still being written too
+func (rn *RootNode) usage() (bytes uint64, files uint64) {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
 
 	for _, node := range rn.Nodes {
-		entries = append(entries, fuse.DirEntry{
-			Name: node.File.OriginalFilename,
-			Mode: node.Inode.Mode(),
-		})
+		bytes += uint64(node.File.OriginalSize)
 	}
+	for id, node := range rn.virtualNodes {
+		if _, found := rn.Nodes[id]; !found {
+			bytes += uint64(node.cf.OriginalSize)
+			files++
+		}
+	}
+	return bytes, files + uint64(len(rn.Nodes))
+}
 
-	for _, node := range rn.virtualNodes {
-		entries = append(entries, fuse.DirEntry{
-			Name: node.name,
-			Mode: node.Inode.Mode(),
-		})
+// parentOf returns the folder with the given id, if it's known. It may be
+// missing when it was removed by another mount
+func (rn *RootNode) parentOf(id string) (*DirInode, bool) {
+	parent, ok := rn.Dirs[id]
+	if !ok {
+		logger.LogWarn(fmt.Sprintf("Parent directory %s not found", id))
 	}
+	return parent, ok
+}
 
-	return fs.NewListDirStream(entries), 0
+// isDescendant tells whether the folder dirId is inside ancestorId
+func (rn *RootNode) isDescendant(dirId, ancestorId string) bool {
+	for dirId != filesystem.ROOT_ID {
+		if dirId == ancestorId {
+			return true
+		}
+		dir, ok := rn.Dirs[dirId]
+		if !ok {
+			return false
+		}
+		dirId = dir.Dir.ParentId
+	}
+	return ancestorId == filesystem.ROOT_ID
 }
 
-func (rn *RootNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	logger.LogInfo(fmt.Sprintf("Looking up for file %s", name))
-	node, ok := rn.Children()[name]
-	if !ok {
-		return nil, syscall.ENOENT
+// AddDirectories adds the given folders to the tree, making sure every parent
+// is added before its children. Folders whose parent can't be found are skipped
+func (rn *RootNode) AddDirectories(dirs []*filesystem.Directory) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.addDirectories(dirs)
+}
+
+// AddFile adds the given file inside its parent folder. If the file was being
+// written from this mount, the virtual node gets replaced by the stored one
+func (rn *RootNode) AddFile(cf *filesystem.ChunkFile) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.addFile(cf)
+}
+
+// AddLinks adds the additional names of the files created by hard links. Links
+// to files that are not in the tree are skipped
+func (rn *RootNode) AddLinks(links []*filesystem.Link) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	for _, link := range links {
+		rn.addLink(link)
+	}
+}
+
+// Sync aligns the tree to the files and folders read from the database. The
+// update is discarded if the tree changed since revision was read, since the
+// data could be older than the local change
+func (rn *RootNode) Sync(revision uint64, dirs []*filesystem.Directory, files []*filesystem.ChunkFile, links []*filesystem.Link) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if rn.revision != revision {
+		logger.LogInfo("Tree changed while reading remote files, skipping sync")
+		return false
+	}
+
+	toDeleteDirs := map[string]bool{}
+	for id := range rn.Dirs {
+		toDeleteDirs[id] = id != filesystem.ROOT_ID
+	}
+	for _, dir := range dirs {
+		toDeleteDirs[dir.Id] = false
+		if node, found := rn.Dirs[dir.Id]; found {
+			rn.moveDirectory(node, dir.ParentId, dir.Name)
+			node.Dir.Attributes = dir.Attributes
+		}
 	}
+	rn.addDirectories(dirs)
 
-	out.SetEntryTimeout(20 * time.Second)
-	out.SetAttrTimeout(10 * time.Second)
+	toDelete := map[string]bool{}
+	for id := range rn.Nodes {
+		toDelete[id] = true
+	}
+	for _, cf := range files {
+		if node, found := rn.Nodes[cf.Id]; found {
+			toDelete[cf.Id] = false
+			rn.moveFile(node, cf.ParentId, cf.OriginalFilename)
+			node.File.RefreshAttributes(cf.Attributes, cf.Nlink)
+		} else {
+			rn.addFile(cf)
+		}
+	}
 
-	if cfNode, ok := rn.Nodes[name]; ok {
-		attr := node.StableAttr()
-		out.Attr.Mode = attr.Mode
-		out.Attr.Ino = attr.Ino
-		out.Size = uint64(cfNode.File.OriginalSize)
+	toDeleteLinks := map[string]bool{}
+	for id := range rn.links {
+		toDeleteLinks[id] = true
+	}
+	for _, link := range links {
+		toDeleteLinks[link.Id] = false
+		if old, found := rn.links[link.Id]; found && !old.Is(link.ParentId, link.Name) {
+			rn.removeLink(old.Id)
+		}
+		rn.addLink(link)
+	}
+	for id := range toDeleteLinks {
+		if toDeleteLinks[id] {
+			rn.removeLink(id)
+		}
+	}
 
-	} else if bInode, ok := rn.virtualNodes[name]; ok {
-		attr := node.StableAttr()
-		out.Attr.Mode = attr.Mode
-		out.Attr.Ino = attr.Ino
-		out.Size = uint64(len(bInode.data))
+	for id := range toDelete {
+		if toDelete[id] {
+			rn.removeFile(id)
+		}
+	}
+	for id := range toDeleteDirs {
+		if toDeleteDirs[id] {
+			rn.removeDirectory(id)
+		}
 	}
 
-	return node, 0
+	return true
 }
 
-func (rn *RootNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	logger.LogInfo(fmt.Sprintf("Creating File %s", name))
+func (rn *RootNode) addDirectories(dirs []*filesystem.Directory) {
+	pending := dirs
+	for len(pending) > 0 {
+		remaining := []*filesystem.Directory{}
+		for _, dir := range pending {
+			if _, found := rn.Dirs[dir.Id]; found {
+				continue
+			}
+			parent, ok := rn.Dirs[dir.ParentId]
+			if !ok {
+				remaining = append(remaining, dir)
+				continue
+			}
 
-	bInode := virtualInode{
-		name: name,
-		mode: mode,
-		cf: &filesystem.ChunkFile{
-			OriginalFilename: name,
-			Id:               uuid.NewString(),
-		},
+			dInode := &DirInode{Dir: dir, root: rn}
+			ch := parent.NewInode(
+				context.Background(),
+				dInode,
+				fs.StableAttr{Mode: syscall.S_IFDIR},
+			)
+			parent.AddChild(dir.Name, ch, true)
+			rn.Dirs[dir.Id] = dInode
+			logger.LogInfo(fmt.Sprintf("Added new directory to filesystem: %s", dir.Name))
+		}
+
+		if len(remaining) == len(pending) {
+			for _, dir := range remaining {
+				logger.LogErr(fmt.Sprintf("Directory %s has no parent, skipping it", dir.Name))
+			}
+			break
+		}
+		pending = remaining
 	}
+}
 
-	ch := rn.NewInode(
-		ctx,
-		&bInode,
-		fs.StableAttr{Mode: mode},
+// addFile places the file inside its parent folder. Files whose parent is not
+// known are skipped, rather than taking the place of an entry of another folder
+func (rn *RootNode) addFile(cf *filesystem.ChunkFile) {
+	parent, ok := rn.parentOf(cf.ParentId)
+	if !ok {
+		logger.LogErr(fmt.Sprintf("File %s has no parent, skipping it", cf.OriginalFilename))
+		return
+	}
+	inode := CfInode{File: cf}
+	ch := parent.NewInode(
+		context.Background(),
+		&inode,
+		fs.StableAttr{Mode: fileMode(cf)},
 	)
-	rn.AddChild(name, ch, false)
-	rn.virtualNodes[name] = &bInode
+	parent.AddChild(cf.OriginalFilename, ch, true)
+	rn.Nodes[cf.Id] = &inode
+	delete(rn.virtualNodes, cf.Id)
+	logger.LogInfo(fmt.Sprintf("Added new file to filesystem: %s", cf.OriginalFilename))
+}
+
+// addLink places the file under the additional name given by the link, if the
+// name doesn't already point to it
+func (rn *RootNode) addLink(link *filesystem.Link) {
+	node, ok := rn.Nodes[link.FileId]
+	if !ok {
+		logger.LogWarn(fmt.Sprintf("File %s of link %s not found, skipping it", link.FileId, link.Name))
+		return
+	}
+	parent, ok := rn.parentOf(link.ParentId)
+	if !ok {
+		logger.LogErr(fmt.Sprintf("Link %s has no parent, skipping it", link.Name))
+		return
+	}
+	if parent.GetChild(link.Name) != &node.Inode {
+		parent.AddChild(link.Name, &node.Inode, true)
+	}
+	rn.links[link.Id] = link
+}
+
+// removeLink drops the name given by the link. The name is kept when it has
+// become the name of the file itself, since the link was promoted on unlink
+func (rn *RootNode) removeLink(id string) {
+	link, ok := rn.links[id]
+	if !ok {
+		return
+	}
+	delete(rn.links, id)
+
+	node, ok := rn.Nodes[link.FileId]
+	if !ok || link.Is(node.File.ParentId, node.File.OriginalFilename) {
+		return
+	}
+	rn.removeChild(&node.Inode, link.ParentId, link.Name)
+	logger.LogInfo(fmt.Sprintf("Deleted link %s from tree", link.Name))
+}
+
+// linksOf returns the additional names of the file
+func (rn *RootNode) linksOf(fileId string) []*filesystem.Link {
+	links := []*filesystem.Link{}
+	for _, link := range rn.links {
+		if link.FileId == fileId {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// linkAt returns the link of the file with the given name, or nil when the name
+// is the one stored in the file itself
+func (rn *RootNode) linkAt(fileId, parentId, name string) *filesystem.Link {
+	for _, link := range rn.links {
+		if link.FileId == fileId && link.Is(parentId, name) {
+			return link
+		}
+	}
+	return nil
+}
+
+// moveFile moves the file to the given folder and name if it's not there yet
+func (rn *RootNode) moveFile(node *CfInode, parentId, name string) {
+	cf := node.File
+	if cf.ParentId == parentId && cf.OriginalFilename == name {
+		return
+	}
+	if rn.moveChild(&node.Inode, cf.ParentId, cf.OriginalFilename, parentId, name) {
+		logger.LogInfo(fmt.Sprintf("Moved file %s to %s", cf.OriginalFilename, name))
+		cf.ParentId = parentId
+		cf.OriginalFilename = name
+	}
+}
 
-	return ch, nil, 0, 0
+// moveDirectory moves the folder to the given parent and name if it's not there yet
+func (rn *RootNode) moveDirectory(node *DirInode, parentId, name string) {
+	dir := node.Dir
+	if dir.ParentId == parentId && dir.Name == name {
+		return
+	}
+	if rn.isDescendant(parentId, dir.Id) {
+		logger.LogErr(fmt.Sprintf("Cannot move directory %s inside itself", dir.Name))
+		return
+	}
+	if rn.moveChild(&node.Inode, dir.ParentId, dir.Name, parentId, name) {
+		logger.LogInfo(fmt.Sprintf("Moved directory %s to %s", dir.Name, name))
+		dir.ParentId = parentId
+		dir.Name = name
+	}
+}
+
+// moveChild moves node from the given name, since a file with hard links has
+// more than one parent
+func (rn *RootNode) moveChild(node *fs.Inode, oldParentId, oldName, parentId, name string) bool {
+	oldParent, ok := rn.parentOf(oldParentId)
+	if !ok || oldParent.GetChild(oldName) != node {
+		return false
+	}
+	newParent, ok := rn.parentOf(parentId)
+	if !ok {
+		return false
+	}
+	return oldParent.MvChild(oldName, newParent.EmbeddedInode(), name, true)
+}
+
+func (rn *RootNode) removeFile(id string) {
+	node, ok := rn.Nodes[id]
+	if !ok {
+		return
+	}
+	for _, link := range rn.linksOf(id) {
+		rn.removeLink(link.Id)
+	}
+	rn.removeChild(&node.Inode, node.File.ParentId, node.File.OriginalFilename)
+	delete(rn.Nodes, id)
+	logger.LogInfo(fmt.Sprintf("Deleted file %s from tree", node.File.OriginalFilename))
+}
+
+func (rn *RootNode) removeDirectory(id string) {
+	node, ok := rn.Dirs[id]
+	if !ok || node.Dir.IsRoot() {
+		return
+	}
+	rn.removeChild(&node.Inode, node.Dir.ParentId, node.Dir.Name)
+	delete(rn.Dirs, id)
+	logger.LogInfo(fmt.Sprintf("Deleted directory %s from tree", node.Dir.Name))
+}
+
+func (rn *RootNode) removeChild(node *fs.Inode, parentId, name string) {
+	parent, ok := rn.parentOf(parentId)
+	if !ok || parent.GetChild(name) != node {
+		return
+	}
+	success, live := parent.RmChild(name)
+	if !live {
+		panic("Root node was removed")
+	}
+	if !success {
+		logger.LogErr(fmt.Sprintf("Failed to remove node %s", name))
+	}
+}
+
+// fileMode returns the type of the node of the file
+func fileMode(cf *filesystem.ChunkFile) uint32 {
+	if cf.IsSymlink() {
+		return syscall.S_IFLNK
+	}
+	return syscall.S_IFREG
 }
@@ -0,0 +1,180 @@
+package tgfuse
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+	"it.smaso/tgfuse/configs"
+	db "it.smaso/tgfuse/database"
+	"it.smaso/tgfuse/filesystem"
+	"it.smaso/tgfuse/logger"
+)
+
+// XATTR_PREFIX is the namespace of the read-only attributes describing how a
+// file is stored
+const XATTR_PREFIX = "user.tgfuse."
+
+// XATTR_PINNED is writable, setting it on a file or a directory keeps its
+// content in the cache, see filesystem.SetPinned
+const XATTR_PINNED = XATTR_PREFIX + "pinned"
+
+// XATTR_CHUNKING is writable too, it selects how the content written to the
+// file from then on is cut in chunks, see filesystem.ChunkFile.SetChunking
+const XATTR_CHUNKING = XATTR_PREFIX + "chunking"
+
+// storageXattrs returns the synthetic attributes of the file: its id, the
+// number of chunks and where each chunk currently is
+func storageXattrs(cf *filesystem.ChunkFile) map[string][]byte {
+	states := cf.ChunkStates()
+	attrs := map[string][]byte{
+		XATTR_PREFIX + "id":     []byte(cf.Id),
+		XATTR_PREFIX + "chunks": []byte(strconv.Itoa(len(states))),
+		XATTR_CHUNKING:          []byte(cf.ChunkingStrategy()),
+	}
+	for idx, state := range states {
+		attrs[fmt.Sprintf("%schunk.%d", XATTR_PREFIX, idx)] = []byte(state)
+	}
+	if filesystem.IsPinned(cf.Id) {
+		attrs[XATTR_PINNED] = []byte("1")
+	}
+	return attrs
+}
+
+// setPinned pins or unpins the file or directory with the given id. The content
+// of what's pinned is downloaded in background by prefetch
+func setPinned(id string, pinned bool, prefetch func()) syscall.Errno {
+	if err := filesystem.SetPinned(id, pinned); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to store pin of %s: %s", id, err.Error()))
+		return syscall.EIO
+	}
+	if pinned {
+		go prefetch()
+	}
+	return 0
+}
+
+// setChunking changes the chunking strategy of the file, storing it right away
+// if the file is stored already
+func setChunking(cf *filesystem.ChunkFile, strategy string, stored bool) syscall.Errno {
+	if !filesystem.IsValidChunking(strategy) {
+		return syscall.EINVAL
+	}
+	cf.SetChunking(strategy)
+	if stored {
+		return saveFile(cf)
+	}
+	return 0
+}
+
+// forgetPin drops the pin of a deleted file or directory
+func forgetPin(id string) {
+	if err := filesystem.SetPinned(id, false); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to remove pin of %s: %s", id, err.Error()))
+	}
+}
+
+// prefetchFile downloads the chunks of the file that are not cached yet
+func prefetchFile(cf *filesystem.ChunkFile) {
+	cf.WaitForReadable()
+	if err := cf.Prefetch(); err != nil {
+		logger.LogErr(fmt.Sprintf("Failed to prefetch %s: %s", cf.OriginalFilename, err.Error()))
+	}
+}
+
+// copyXattr copies value into dest following the getxattr conventions, where an
+// empty dest asks for the size only
+func copyXattr(value, dest []byte) (uint32, syscall.Errno) {
+	if len(dest) == 0 {
+		return uint32(len(value)), 0
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+func getxattr(cf *filesystem.ChunkFile, attr string, dest []byte) (uint32, syscall.Errno) {
+	if strings.HasPrefix(attr, XATTR_PREFIX) {
+		if value, ok := storageXattrs(cf)[attr]; ok {
+			return copyXattr(value, dest)
+		}
+	}
+	if value, ok := cf.GetXattr(attr); ok {
+		return copyXattr(value, dest)
+	}
+	return 0, syscall.Errno(fuse.ENOATTR)
+}
+
+func listxattr(cf *filesystem.ChunkFile, dest []byte) (uint32, syscall.Errno) {
+	names := slices.Sorted(maps.Keys(storageXattrs(cf)))
+	names = append(names, cf.XattrNames()...)
+
+	list := bytes.Buffer{}
+	for _, name := range names {
+		list.WriteString(name)
+		list.WriteByte(0)
+	}
+	return copyXattr(list.Bytes(), dest)
+}
+
+// setxattr stores a user attribute. When the file is not stored yet, the
+// attribute is saved together with it
+func setxattr(cf *filesystem.ChunkFile, attr string, data []byte, flags uint32, stored bool) syscall.Errno {
+	if !strings.HasPrefix(attr, "user.") {
+		return syscall.ENOTSUP
+	}
+	if attr == XATTR_PINNED {
+		return setPinned(cf.Id, true, func() { prefetchFile(cf) })
+	}
+	if attr == XATTR_CHUNKING {
+		return setChunking(cf, string(data), stored)
+	}
+	if strings.HasPrefix(attr, XATTR_PREFIX) {
+		return syscall.EPERM
+	}
+
+	_, exists := cf.GetXattr(attr)
+	if flags&unix.XATTR_CREATE != 0 && exists {
+		return syscall.EEXIST
+	}
+	if flags&unix.XATTR_REPLACE != 0 && !exists {
+		return syscall.Errno(fuse.ENOATTR)
+	}
+
+	if stored {
+		if err := db.Connect(configs.DB_CONFIG).SetXattr(cf, attr, data); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to store xattr %s of %s: %s", attr, cf.OriginalFilename, err.Error()))
+			return syscall.EIO
+		}
+	}
+	cf.SetXattr(attr, data)
+	return 0
+}
+
+func removexattr(cf *filesystem.ChunkFile, attr string, stored bool) syscall.Errno {
+	if attr == XATTR_PINNED && filesystem.IsPinned(cf.Id) {
+		return setPinned(cf.Id, false, nil)
+	}
+	if strings.HasPrefix(attr, XATTR_PREFIX) {
+		return syscall.EPERM
+	}
+	if _, exists := cf.GetXattr(attr); !exists {
+		return syscall.Errno(fuse.ENOATTR)
+	}
+
+	if stored {
+		if err := db.Connect(configs.DB_CONFIG).RemoveXattr(cf, attr); err != nil {
+			logger.LogErr(fmt.Sprintf("Failed to remove xattr %s of %s: %s", attr, cf.OriginalFilename, err.Error()))
+			return syscall.EIO
+		}
+	}
+	cf.RemoveXattr(attr)
+	return 0
+}